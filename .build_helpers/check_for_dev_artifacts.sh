@@ -36,7 +36,7 @@ function check_for_dev_artifacts() {
 	# Quick staticcheck check - ignoring punctuation in error strings
 	cd "$src"
 	set +e
-	staticcheck ./*.go | grep -Ev "error strings should not"
+	staticcheck . | grep -Ev "error strings should not"
 	set -e
 	cd "$repoDir"/
 
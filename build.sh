@@ -112,7 +112,7 @@ function compile_program() {
 	then
 		musl_build_static "$GOARCH" "$GOOS" "$repoRoot" "$outputEXE"
 	else
-		go build -o "$repoRoot"/"$outputEXE" -a -ldflags '-s -w -buildid= ' ./*.go
+		go build -o "$repoRoot"/"$outputEXE" -a -ldflags '-s -w -buildid= ' .
 	fi
 	cd "$repoRoot"
 
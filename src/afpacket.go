@@ -0,0 +1,320 @@
+// wakeonlanpve
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+)
+
+// Capture through a Linux AF_PACKET socket with a TPACKET_V3 memory mapped receive ring
+// Packets are filtered in the kernel by a BPF program compiled in Go, so libpcap is not used
+type afpacketCapture struct {
+	fd     int
+	wakeFD int // Eventfd polled with the socket, so Close can wake a blocked read
+	ring   []byte
+
+	// Held while reading, so Close can wait for the reader before releasing the socket and ring
+	readMutex sync.Mutex
+
+	// Position in the ring (only used by the reading goroutine)
+	blockIndex    int
+	blockOpen     bool
+	packetsLeft   uint32
+	packetOffset  uint32
+	closed        atomic.Bool
+	statsMutex    sync.Mutex
+	receivedTotal int
+	droppedTotal  int
+}
+
+// Receive ring size - WOL traffic is sparse, so a small ring is enough
+const (
+	afpacketBlockSize  uint32 = 1 << 16
+	afpacketBlockCount uint32 = 16
+	afpacketFrameSize  uint32 = 1 << 11
+)
+
+// Maximum time the kernel holds packets in a block that is not full, before handing it to the server
+const afpacketBlockTimeoutMs uint32 = 100
+
+// Offset of block status in a TPACKET_V3 block descriptor (after version and offset to private area)
+const afpacketBlockHeaderOffset uintptr = 8
+
+// ###################################
+//	OPEN AF_PACKET CAPTURE
+// ###################################
+
+// Opens AF_PACKET capture on the interface with the BPF program attached before any packet is received
+func openAFPacketCapture(listenIntf string, program []unix.SockFilter, promiscMode bool) (capture *afpacketCapture, err error) {
+	captureInterface, err := net.InterfaceByName(listenIntf)
+	if err != nil {
+		err = fmt.Errorf("failed to open capture device: %v", err)
+		return
+	}
+
+	// Protocol 0 receives nothing until the socket is bound below
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		err = fmt.Errorf("failed to create AF_PACKET socket: %v", err)
+		return
+	}
+
+	wakeFD, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		unix.Close(fd)
+		err = fmt.Errorf("failed to create capture wakeup event: %v", err)
+		return
+	}
+
+	capture = &afpacketCapture{fd: fd, wakeFD: wakeFD}
+	err = capture.setup(captureInterface.Index, program, promiscMode)
+	if err != nil {
+		capture.Close()
+		capture = nil
+		err = fmt.Errorf("failed to setup AF_PACKET capture on %s: %v", listenIntf, err)
+		return
+	}
+	return
+}
+
+// Attaches filter, maps the receive ring, and binds the socket to the interface
+func (capture *afpacketCapture) setup(interfaceIndex int, program []unix.SockFilter, promiscMode bool) (err error) {
+	filter := unix.SockFprog{Len: uint16(len(program)), Filter: &program[0]}
+	err = unix.SetsockoptSockFprog(capture.fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &filter)
+	if err != nil {
+		err = fmt.Errorf("attach BPF filter: %v", err)
+		return
+	}
+
+	err = unix.SetsockoptInt(capture.fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3)
+	if err != nil {
+		err = fmt.Errorf("set TPACKET_V3: %v", err)
+		return
+	}
+
+	ringRequest := unix.TpacketReq3{
+		Block_size:     afpacketBlockSize,
+		Block_nr:       afpacketBlockCount,
+		Frame_size:     afpacketFrameSize,
+		Frame_nr:       afpacketBlockSize / afpacketFrameSize * afpacketBlockCount,
+		Retire_blk_tov: afpacketBlockTimeoutMs,
+	}
+	err = unix.SetsockoptTpacketReq3(capture.fd, unix.SOL_PACKET, unix.PACKET_RX_RING, &ringRequest)
+	if err != nil {
+		err = fmt.Errorf("create receive ring: %v", err)
+		return
+	}
+
+	capture.ring, err = unix.Mmap(capture.fd, 0, int(afpacketBlockSize*afpacketBlockCount), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		err = fmt.Errorf("map receive ring: %v", err)
+		return
+	}
+
+	if promiscMode {
+		membership := unix.PacketMreq{Ifindex: int32(interfaceIndex), Type: unix.PACKET_MR_PROMISC}
+		err = unix.SetsockoptPacketMreq(capture.fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &membership)
+		if err != nil {
+			err = fmt.Errorf("enable promiscuous mode: %v", err)
+			return
+		}
+	}
+
+	err = unix.Bind(capture.fd, &unix.SockaddrLinklayer{Protocol: hostToNetworkShort(unix.ETH_P_ALL), Ifindex: interfaceIndex})
+	if err != nil {
+		err = fmt.Errorf("bind to interface: %v", err)
+		return
+	}
+	return
+}
+
+// Converts 16 bit value to network byte order (socket protocol field)
+func hostToNetworkShort(value uint16) (networkValue uint16) {
+	valueBytes := binary.BigEndian.AppendUint16(nil, value)
+	networkValue = binary.NativeEndian.Uint16(valueBytes)
+	return
+}
+
+// ###################################
+//	READ AF_PACKET RING
+// ###################################
+
+// Status word of a ring block, shared with the kernel
+func (capture *afpacketCapture) blockStatus(blockIndex int) (status *uint32) {
+	blockStart := uintptr(blockIndex) * uintptr(afpacketBlockSize)
+	status = (*uint32)(unsafe.Pointer(&capture.ring[blockStart+afpacketBlockHeaderOffset]))
+	return
+}
+
+// Retrieves the next packet from the ring, waiting for the kernel to hand over a block if none is ready
+// VLAN tags removed by the kernel are put back into the frame, as libpcap does
+func (capture *afpacketCapture) ReadPacketData() (data []byte, captureInfo gopacket.CaptureInfo, err error) {
+	capture.readMutex.Lock()
+	defer capture.readMutex.Unlock()
+
+	for {
+		if capture.closed.Load() {
+			err = io.EOF
+			return
+		}
+
+		blockStart := uint32(capture.blockIndex) * afpacketBlockSize
+
+		if !capture.blockOpen {
+			if atomic.LoadUint32(capture.blockStatus(capture.blockIndex))&unix.TP_STATUS_USER == 0 {
+				err = capture.waitForBlock()
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			blockHeader := (*unix.TpacketHdrV1)(unsafe.Pointer(&capture.ring[uintptr(blockStart)+afpacketBlockHeaderOffset]))
+			capture.blockOpen = true
+			capture.packetsLeft = blockHeader.Num_pkts
+			capture.packetOffset = blockHeader.Offset_to_first_pkt
+		}
+
+		// Return block to kernel once every packet was read
+		if capture.packetsLeft == 0 {
+			atomic.StoreUint32(capture.blockStatus(capture.blockIndex), unix.TP_STATUS_KERNEL)
+			capture.blockOpen = false
+			capture.blockIndex = (capture.blockIndex + 1) % int(afpacketBlockCount)
+			continue
+		}
+
+		packetStart := blockStart + capture.packetOffset
+		packetHeader := (*unix.Tpacket3Hdr)(unsafe.Pointer(&capture.ring[packetStart]))
+		frameStart := packetStart + uint32(packetHeader.Mac)
+		frame := capture.ring[frameStart : frameStart+packetHeader.Snaplen]
+
+		// Copy out of the ring, since the block is given back to the kernel
+		frameLength := int(packetHeader.Len)
+		if packetHeader.Status&unix.TP_STATUS_VLAN_VALID != 0 && len(frame) >= 12 {
+			VLANProtocol := uint16(etherTypeDot1Q)
+			if packetHeader.Status&unix.TP_STATUS_VLAN_TPID_VALID != 0 {
+				VLANProtocol = packetHeader.Hv1.Vlan_tpid
+			}
+
+			data = make([]byte, 0, len(frame)+dot1QTagLength)
+			data = append(data, frame[:12]...)
+			data = binary.BigEndian.AppendUint16(data, VLANProtocol)
+			data = binary.BigEndian.AppendUint16(data, uint16(packetHeader.Hv1.Vlan_tci))
+			data = append(data, frame[12:]...)
+			frameLength += dot1QTagLength
+		} else {
+			data = append([]byte(nil), frame...)
+		}
+
+		captureInfo = gopacket.CaptureInfo{
+			Timestamp:      time.Unix(int64(packetHeader.Sec), int64(packetHeader.Nsec)),
+			CaptureLength:  len(data),
+			Length:         frameLength,
+			InterfaceIndex: 0,
+		}
+
+		capture.packetOffset += packetHeader.Next_offset
+		capture.packetsLeft--
+		return
+	}
+}
+
+// Waits until the kernel signals a filled block, or Close signals the wakeup event (io.EOF)
+// Socket errors (like ENETDOWN when the interface goes down) are read and cleared, so the next wait blocks again
+func (capture *afpacketCapture) waitForBlock() (err error) {
+	pollFDs := []unix.PollFd{
+		{Fd: int32(capture.fd), Events: unix.POLLIN | unix.POLLERR},
+		{Fd: int32(capture.wakeFD), Events: unix.POLLIN},
+	}
+
+	_, err = unix.Poll(pollFDs, -1)
+	if err == unix.EINTR {
+		err = nil
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to wait for packets: %v", err)
+		return
+	}
+
+	if pollFDs[1].Revents != 0 {
+		err = io.EOF
+		return
+	}
+
+	if pollFDs[0].Revents&(unix.POLLERR|unix.POLLHUP|unix.POLLNVAL) != 0 {
+		socketError, sockoptErr := unix.GetsockoptInt(capture.fd, unix.SOL_SOCKET, unix.SO_ERROR)
+		if sockoptErr != nil {
+			err = fmt.Errorf("failed to read capture socket error: %v", sockoptErr)
+			return
+		}
+		if socketError != 0 {
+			err = fmt.Errorf("capture socket error: %v", unix.Errno(socketError))
+			return
+		}
+		err = fmt.Errorf("capture socket not readable (poll events 0x%x)", pollFDs[0].Revents)
+		return
+	}
+	return
+}
+
+func (capture *afpacketCapture) LinkType() (linkType layers.LinkType) {
+	linkType = layers.LinkTypeEthernet
+	return
+}
+
+// Kernel counters are reset on every read, so totals are kept here
+func (capture *afpacketCapture) Stats() (stats captureStats, err error) {
+	capture.statsMutex.Lock()
+	defer capture.statsMutex.Unlock()
+
+	if capture.closed.Load() {
+		err = fmt.Errorf("capture is closed")
+		return
+	}
+
+	kernelStats, err := unix.GetsockoptTpacketStatsV3(capture.fd, unix.SOL_PACKET, unix.PACKET_STATISTICS)
+	if err != nil {
+		err = fmt.Errorf("failed to read AF_PACKET statistics: %v", err)
+		return
+	}
+
+	// Kernel includes dropped packets in the packet count, only those that reached the ring are counted as received
+	capture.receivedTotal += int(kernelStats.Packets) - int(kernelStats.Drops)
+	capture.droppedTotal += int(kernelStats.Drops)
+
+	stats = captureStats{received: capture.receivedTotal, dropped: capture.droppedTotal}
+	return
+}
+
+// Wakes a blocked read and waits for it to return (io.EOF) before releasing the socket and ring
+func (capture *afpacketCapture) Close() {
+	if capture.closed.Swap(true) {
+		return
+	}
+
+	wakeValue := binary.NativeEndian.AppendUint64(nil, 1)
+	unix.Write(capture.wakeFD, wakeValue)
+
+	capture.readMutex.Lock()
+	defer capture.readMutex.Unlock()
+	capture.statsMutex.Lock()
+	defer capture.statsMutex.Unlock()
+
+	if capture.ring != nil {
+		unix.Munmap(capture.ring)
+		capture.ring = nil
+	}
+	unix.Close(capture.fd)
+	unix.Close(capture.wakeFD)
+}
@@ -0,0 +1,150 @@
+// wakeonlanpve
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Close must wake a read blocked waiting for packets, and the read must return before the socket is released
+func TestAFPacketCloseWakesBlockedRead(t *testing.T) {
+	// Rejects every packet, so the read can only return through Close
+	rejectAll := []unix.SockFilter{{Code: unix.BPF_RET | unix.BPF_K, K: 0}}
+
+	capture, err := openAFPacketCapture("lo", rejectAll, false)
+	if err != nil {
+		t.Skipf("AF_PACKET capture not available: %v", err)
+	}
+
+	readResult := make(chan error, 1)
+	go func() {
+		_, _, err := capture.ReadPacketData()
+		readResult <- err
+	}()
+
+	// Give the reader time to block in poll
+	time.Sleep(100 * time.Millisecond)
+
+	closeDone := make(chan struct{})
+	go func() {
+		capture.Close()
+		close(closeDone)
+	}()
+
+	select {
+	case err = <-readResult:
+		if err != io.EOF {
+			t.Fatalf("expected io.EOF from read after close, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("blocked read did not return after close")
+	}
+
+	select {
+	case <-closeDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("close did not return after the read exited")
+	}
+
+	if capture.ring != nil {
+		t.Error("expected receive ring to be unmapped after close")
+	}
+
+	_, err = capture.Stats()
+	if err == nil {
+		t.Error("expected stats on a closed capture to fail")
+	}
+
+	// Reads and closes after close must not touch the released descriptors
+	_, _, err = capture.ReadPacketData()
+	if err != io.EOF {
+		t.Errorf("expected io.EOF from read on closed capture, got %v", err)
+	}
+	capture.Close()
+}
+
+// A pending socket error must be returned (and cleared) instead of the wait returning nil in a busy loop
+func TestAFPacketWaitReturnsSocketError(t *testing.T) {
+	// Connected UDP socket to a closed local port, the ICMP port unreachable sets ECONNREFUSED as the socket error
+	closedPort, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("failed to create socket: %v", err)
+	}
+	err = unix.Bind(closedPort, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("failed to bind socket: %v", err)
+	}
+	closedAddress, err := unix.Getsockname(closedPort)
+	if err != nil {
+		t.Fatalf("failed to get socket address: %v", err)
+	}
+	unix.Close(closedPort)
+
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("failed to create socket: %v", err)
+	}
+	wakeFD, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		t.Fatalf("failed to create eventfd: %v", err)
+	}
+	capture := &afpacketCapture{fd: fd, wakeFD: wakeFD}
+	defer capture.Close()
+
+	err = unix.Connect(fd, closedAddress)
+	if err != nil {
+		t.Fatalf("failed to connect socket: %v", err)
+	}
+	_, err = unix.Write(fd, []byte{0})
+	if err != nil {
+		t.Fatalf("failed to send to closed port: %v", err)
+	}
+
+	waitResult := make(chan error, 1)
+	go func() {
+		waitResult <- capture.waitForBlock()
+	}()
+
+	select {
+	case err = <-waitResult:
+		if err == nil || !strings.Contains(err.Error(), unix.ECONNREFUSED.Error()) {
+			t.Fatalf("expected socket error %q, got %v", unix.ECONNREFUSED.Error(), err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("wait did not return for socket error")
+	}
+
+	socketError, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err != nil || socketError != 0 {
+		t.Errorf("expected socket error to be cleared, got %d (%v)", socketError, err)
+	}
+}
+
+// A signalled wakeup event must end the wait with io.EOF, without relying on the closed flag
+func TestAFPacketWaitReturnsEOFOnWakeup(t *testing.T) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("failed to create socket: %v", err)
+	}
+	wakeFD, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		t.Fatalf("failed to create eventfd: %v", err)
+	}
+	capture := &afpacketCapture{fd: fd, wakeFD: wakeFD}
+	defer capture.Close()
+
+	_, err = unix.Write(wakeFD, binary.NativeEndian.AppendUint64(nil, 1))
+	if err != nil {
+		t.Fatalf("failed to signal eventfd: %v", err)
+	}
+
+	err = capture.waitForBlock()
+	if err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
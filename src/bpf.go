@@ -0,0 +1,505 @@
+// wakeonlanpve
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Classic BPF program assembler with symbolic forward jump targets
+type bpfAssembler struct {
+	instructions []bpfInstruction
+	labels       []int // Instruction index of each label
+}
+
+type bpfInstruction struct {
+	filter    unix.SockFilter
+	jumpTrue  int // Label, or bpfNext
+	jumpFalse int // Label, or bpfNext
+}
+
+// Jump target meaning the instruction after the jump
+const bpfNext int = -1
+
+// Kernel limit on classic BPF program length
+const bpfMaxInstructions int = 4096
+
+// Single comparison of packet data - the loaded value (after mask) must be within min and max
+type bpfCheck struct {
+	size     uint16 // unix.BPF_B, unix.BPF_H, or unix.BPF_W
+	offset   uint32
+	indirect bool   // Offset is relative to the X register (IPv4 header length)
+	mask     uint32 // Not applied if 0
+	min      uint32
+	max      uint32
+}
+
+// Group of checks that must all pass
+type bpfMatch []bpfCheck
+
+// EtherTypes checked by the AF_PACKET filter
+const (
+	etherTypeIPv4  uint32 = 0x0800
+	etherTypeIPv6  uint32 = 0x86dd
+	etherTypeDot1Q uint32 = 0x8100
+	etherTypeQinQ  uint32 = 0x88a8
+)
+
+// ###################################
+//	COMPILE CAPTURE FILTER
+// ###################################
+
+// Compiles listen interface parameters into a classic BPF program for AF_PACKET sockets
+// Matches the same packets as the libpcap filter expression from buildPCAPFilter (rawFilter is not supported)
+func compileBPFFilter(PCAPParameters ListenInterfaceParams) (program []unix.SockFilter, err error) {
+	if PCAPParameters.RawFilter != "" {
+		err = fmt.Errorf("rawFilter is not supported by the %s capture backend", captureBackendAFPacket)
+		return
+	}
+
+	srcMACs, err := bpfMACMatches(PCAPParameters.FilterSrcMAC, 6)
+	if err != nil {
+		err = fmt.Errorf("filterSrcMAC: %v", err)
+		return
+	}
+	dstMACs, err := bpfMACMatches(PCAPParameters.FilterDstMAC, 0)
+	if err != nil {
+		err = fmt.Errorf("filterDstMAC: %v", err)
+		return
+	}
+	srcIPs, err := parseFilterNetworks(PCAPParameters.FilterSrcIP)
+	if err != nil {
+		err = fmt.Errorf("filterSrcIP: %v", err)
+		return
+	}
+	dstIPs, err := parseFilterNetworks(PCAPParameters.FilterDstIP)
+	if err != nil {
+		err = fmt.Errorf("filterDstIP: %v", err)
+		return
+	}
+	var dstPortEntries []string
+	if strings.TrimSpace(PCAPParameters.FilterDstPort) != "" {
+		dstPortEntries = strings.Split(PCAPParameters.FilterDstPort, ",")
+	}
+	includedPorts, excludedPorts := splitFilterEntries(dstPortEntries)
+
+	asm := &bpfAssembler{}
+
+	// Frames with the VLAN tag removed by the kernel (usual case) or still in the frame (stacked tags, no offload)
+	for _, linkHeaderLength := range []uint32{uint32(ethernetHeaderLength), uint32(ethernetHeaderLength + dot1QTagLength)} {
+		var frameChecks []bpfMatch
+		if linkHeaderLength > uint32(ethernetHeaderLength) {
+			frameChecks = []bpfMatch{
+				{bpfEqual(unix.BPF_H, 12, etherTypeDot1Q)},
+				{bpfEqual(unix.BPF_H, 12, etherTypeQinQ)},
+			}
+		}
+
+		for _, IPv6 := range []bool{false, true} {
+			// IP and port offsets for this IP version
+			var srcIPOffset, dstIPOffset, udpOffset uint32
+			var indirect bool
+			if IPv6 {
+				srcIPOffset, dstIPOffset, udpOffset = linkHeaderLength+8, linkHeaderLength+24, linkHeaderLength+uint32(ipv6HeaderLength)
+			} else {
+				srcIPOffset, dstIPOffset, udpOffset, indirect = linkHeaderLength+12, linkHeaderLength+16, linkHeaderLength, true
+			}
+
+			srcIPMatches, srcIPExclusions, possible := bpfNetworkMatches(srcIPs, srcIPOffset, IPv6)
+			if !possible {
+				continue
+			}
+			dstIPMatches, dstIPExclusions, possible := bpfNetworkMatches(dstIPs, dstIPOffset, IPv6)
+			if !possible {
+				continue
+			}
+
+			branch := asm.startBranch()
+			branch.requireAny(frameChecks)
+			if IPv6 {
+				branch.require(bpfEqual(unix.BPF_H, linkHeaderLength-2, etherTypeIPv6), bpfEqual(unix.BPF_B, linkHeaderLength+6, 17))
+			} else {
+				// UDP header is only present in the first fragment
+				branch.require(bpfEqual(unix.BPF_H, linkHeaderLength-2, etherTypeIPv4), bpfEqual(unix.BPF_B, linkHeaderLength+9, 17),
+					bpfCheck{size: unix.BPF_H, offset: linkHeaderLength + 6, mask: 0x1fff})
+			}
+			branch.requireAny(srcMACs.included)
+			branch.requireNone(srcMACs.excluded)
+			branch.requireAny(srcIPMatches)
+			branch.requireNone(srcIPExclusions)
+			branch.requireAny(dstIPMatches)
+			branch.requireNone(dstIPExclusions)
+			branch.requireAny(dstMACs.included)
+			branch.requireNone(dstMACs.excluded)
+
+			// Variable IPv4 header length - UDP offsets are relative to X from here
+			if indirect {
+				branch.loadIPv4HeaderLength(linkHeaderLength)
+			}
+
+			var portMatches, portExclusions []bpfMatch
+			for _, entry := range includedPorts {
+				portMatches = append(portMatches, bpfPortMatch(entry, udpOffset+2, indirect))
+			}
+			for _, entry := range excludedPorts {
+				portExclusions = append(portExclusions, bpfPortMatch(entry, udpOffset+2, indirect))
+			}
+			branch.requireAny(portMatches)
+			branch.requireNone(portExclusions)
+
+			branch.requireAny(bpfPrefilterMatches(PCAPParameters, udpOffset, indirect))
+			branch.accept()
+		}
+
+		if PCAPParameters.RawEthernetWOL {
+			branch := asm.startBranch()
+			branch.requireAny(frameChecks)
+			branch.require(bpfEqual(unix.BPF_H, linkHeaderLength-2, uint32(etherTypeWOL)))
+			branch.requireAny(srcMACs.included)
+			branch.requireNone(srcMACs.excluded)
+			if PCAPParameters.KernelPrefilter != "" {
+				branch.require(bpfEqual(unix.BPF_W, linkHeaderLength, 0xffffffff), bpfEqual(unix.BPF_H, linkHeaderLength+4, 0xffff))
+			}
+			branch.accept()
+		}
+	}
+
+	// Nothing matched
+	asm.returnValue(0)
+
+	program, err = asm.assemble()
+	return
+}
+
+// ###################################
+//	FILTER ENTRY MATCHES
+// ###################################
+
+// Included and excluded entries of one filter list as BPF matches
+type bpfMatchList struct {
+	included []bpfMatch
+	excluded []bpfMatch
+}
+
+// MAC address entries compared at the frame offset (0 for destination, 6 for source)
+func bpfMACMatches(entries []string, offset uint32) (matches bpfMatchList, err error) {
+	included, excluded := splitFilterEntries(entries)
+
+	toMatch := func(entry string) (match bpfMatch, err error) {
+		MAC, err := net.ParseMAC(entry)
+		if err != nil || len(MAC) != 6 {
+			err = fmt.Errorf("invalid MAC address '%s'", entry)
+			return
+		}
+
+		match = bpfMatch{
+			bpfEqual(unix.BPF_H, offset, uint32(binary.BigEndian.Uint16(MAC[0:2]))),
+			bpfEqual(unix.BPF_W, offset+2, binary.BigEndian.Uint32(MAC[2:6])),
+		}
+		return
+	}
+
+	for _, entry := range included {
+		var match bpfMatch
+		match, err = toMatch(entry)
+		if err != nil {
+			return
+		}
+		matches.included = append(matches.included, match)
+	}
+	for _, entry := range excluded {
+		var match bpfMatch
+		match, err = toMatch(entry)
+		if err != nil {
+			return
+		}
+		matches.excluded = append(matches.excluded, match)
+	}
+	return
+}
+
+// Included and excluded networks of one IP filter list
+type filterNetworks struct {
+	included []*net.IPNet
+	excluded []*net.IPNet
+}
+
+// Parses IP and CIDR filter entries
+func parseFilterNetworks(entries []string) (networks filterNetworks, err error) {
+	included, excluded := splitFilterEntries(entries)
+
+	for _, entry := range included {
+		var network *net.IPNet
+		network, err = parseIPOrCIDR(entry)
+		if err != nil {
+			return
+		}
+		networks.included = append(networks.included, network)
+	}
+	for _, entry := range excluded {
+		var network *net.IPNet
+		network, err = parseIPOrCIDR(entry)
+		if err != nil {
+			return
+		}
+		networks.excluded = append(networks.excluded, network)
+	}
+	return
+}
+
+// Networks of one IP version compared at the address offset
+// Not possible when only networks of the other IP version are included (the IP version can never match)
+func bpfNetworkMatches(networks filterNetworks, offset uint32, IPv6 bool) (matches []bpfMatch, exclusions []bpfMatch, possible bool) {
+	toMatch := func(network *net.IPNet) (match bpfMatch, sameVersion bool) {
+		IP, mask := network.IP.To4(), network.Mask
+		if IPv6 {
+			if IP != nil {
+				return
+			}
+			IP = network.IP.To16()
+		} else if IP == nil {
+			return
+		}
+		if len(mask) != len(IP) {
+			return
+		}
+		sameVersion = true
+
+		// One check per 32 bit word, skipping words outside of the prefix
+		for word := 0; word < len(IP); word += 4 {
+			wordMask := binary.BigEndian.Uint32(mask[word : word+4])
+			if wordMask == 0 {
+				continue
+			}
+
+			check := bpfEqual(unix.BPF_W, offset+uint32(word), binary.BigEndian.Uint32(IP[word:word+4])&wordMask)
+			if wordMask != 0xffffffff {
+				check.mask = wordMask
+			}
+			match = append(match, check)
+		}
+		return
+	}
+
+	// A zero length prefix results in a match without checks, which always passes
+	for _, network := range networks.included {
+		if match, sameVersion := toMatch(network); sameVersion {
+			matches = append(matches, match)
+		}
+	}
+	for _, network := range networks.excluded {
+		if match, sameVersion := toMatch(network); sameVersion {
+			exclusions = append(exclusions, match)
+		}
+	}
+
+	possible = len(networks.included) == 0 || len(matches) > 0
+	return
+}
+
+// Destination port or port range compared at the UDP destination port offset
+// Entries were validated when the libpcap filter expression was built
+func bpfPortMatch(entry string, offset uint32, indirect bool) (match bpfMatch) {
+	start, end, _ := parsePortRange(entry)
+	match = bpfMatch{{size: unix.BPF_H, offset: offset, indirect: indirect, min: uint32(start), max: uint32(end)}}
+	return
+}
+
+// Payload checks for the kernelPrefilter mode (same as buildPrefilterClauses)
+func bpfPrefilterMatches(PCAPParameters ListenInterfaceParams, udpOffset uint32, indirect bool) (matches []bpfMatch) {
+	if PCAPParameters.KernelPrefilter == "" {
+		return
+	}
+
+	syncStream := bpfMatch{
+		{size: unix.BPF_W, offset: udpOffset + uint32(udpHeaderLength), indirect: indirect, min: 0xffffffff, max: 0xffffffff},
+		{size: unix.BPF_H, offset: udpOffset + uint32(udpHeaderLength) + 4, indirect: indirect, min: 0xffff, max: 0xffff},
+	}
+
+	if PCAPParameters.KernelPrefilter != prefilterLength {
+		matches = []bpfMatch{syncStream}
+		return
+	}
+
+	lengthCheck := bpfCheck{size: unix.BPF_H, offset: udpOffset + 4, indirect: indirect}
+	if PCAPParameters.ValidationMode == validationAllowTrailing {
+		lengthCheck.min, lengthCheck.max = uint32(udpHeaderLength+magicPacketLength), 0xffff
+		matches = []bpfMatch{append(syncStream, lengthCheck)}
+		return
+	}
+
+	// Magic packet with no, 4 byte, or 6 byte SecureOn password
+	for _, passwordLength := range []int{0, 4, 6} {
+		lengthCheck.min = uint32(udpHeaderLength + magicPacketLength + passwordLength)
+		lengthCheck.max = lengthCheck.min
+		matches = append(matches, append(append(bpfMatch{}, syncStream...), lengthCheck))
+	}
+	return
+}
+
+// Check for an exact value at an absolute offset
+func bpfEqual(size uint16, offset uint32, value uint32) (check bpfCheck) {
+	check = bpfCheck{size: size, offset: offset, min: value, max: value}
+	return
+}
+
+// ###################################
+//	BPF ASSEMBLER
+// ###################################
+
+// Instructions for one alternative of the filter - any failed requirement continues with the next branch
+type bpfBranch struct {
+	asm  *bpfAssembler
+	fail int
+}
+
+// Starts a filter alternative
+func (asm *bpfAssembler) startBranch() (branch *bpfBranch) {
+	branch = &bpfBranch{asm: asm, fail: asm.newLabel()}
+	return
+}
+
+// Every check must pass
+func (branch *bpfBranch) require(checks ...bpfCheck) {
+	localFail := branch.asm.newLabel()
+	passed := branch.asm.newLabel()
+
+	branch.asm.emitChecks(checks, localFail)
+	branch.asm.jumpAlways(passed)
+
+	// Far jumps to the next branch go through an unconditional jump
+	branch.asm.mark(localFail)
+	branch.asm.jumpAlways(branch.fail)
+	branch.asm.mark(passed)
+}
+
+// At least one match must pass (no requirement if there are no matches)
+func (branch *bpfBranch) requireAny(matches []bpfMatch) {
+	if len(matches) == 0 {
+		return
+	}
+
+	passed := branch.asm.newLabel()
+	for _, match := range matches {
+		nextMatch := branch.asm.newLabel()
+		branch.asm.emitChecks(match, nextMatch)
+		branch.asm.jumpAlways(passed)
+		branch.asm.mark(nextMatch)
+	}
+
+	branch.asm.jumpAlways(branch.fail)
+	branch.asm.mark(passed)
+}
+
+// No match may pass
+func (branch *bpfBranch) requireNone(matches []bpfMatch) {
+	for _, match := range matches {
+		nextMatch := branch.asm.newLabel()
+		branch.asm.emitChecks(match, nextMatch)
+		branch.asm.jumpAlways(branch.fail)
+		branch.asm.mark(nextMatch)
+	}
+}
+
+// Loads IPv4 header length into X for indirect UDP offsets
+func (branch *bpfBranch) loadIPv4HeaderLength(ipOffset uint32) {
+	branch.asm.emit(unix.BPF_LDX|unix.BPF_B|unix.BPF_MSH, ipOffset, bpfNext, bpfNext)
+}
+
+// Accepts packet if every requirement passed, then starts the next branch
+func (branch *bpfBranch) accept() {
+	branch.asm.returnValue(uint32(captureSnapLen))
+	branch.asm.mark(branch.fail)
+}
+
+// Emits checks, jumping to fail on the first check that does not pass
+func (asm *bpfAssembler) emitChecks(checks []bpfCheck, fail int) {
+	for _, check := range checks {
+		mode := uint16(unix.BPF_ABS)
+		if check.indirect {
+			mode = unix.BPF_IND
+		}
+		asm.emit(unix.BPF_LD|check.size|mode, check.offset, bpfNext, bpfNext)
+
+		if check.mask != 0 {
+			asm.emit(unix.BPF_ALU|unix.BPF_AND|unix.BPF_K, check.mask, bpfNext, bpfNext)
+		}
+
+		if check.min == check.max {
+			asm.emit(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, check.min, bpfNext, fail)
+			continue
+		}
+		if check.min > 0 {
+			asm.emit(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, check.min, bpfNext, fail)
+		}
+		if check.max < 0xffffffff {
+			asm.emit(unix.BPF_JMP|unix.BPF_JGT|unix.BPF_K, check.max, fail, bpfNext)
+		}
+	}
+}
+
+func (asm *bpfAssembler) newLabel() (label int) {
+	label = len(asm.labels)
+	asm.labels = append(asm.labels, -1)
+	return
+}
+
+// Places label at the next instruction
+func (asm *bpfAssembler) mark(label int) {
+	asm.labels[label] = len(asm.instructions)
+}
+
+func (asm *bpfAssembler) emit(code uint16, k uint32, jumpTrue int, jumpFalse int) {
+	asm.instructions = append(asm.instructions, bpfInstruction{
+		filter:    unix.SockFilter{Code: code, K: k},
+		jumpTrue:  jumpTrue,
+		jumpFalse: jumpFalse,
+	})
+}
+
+func (asm *bpfAssembler) jumpAlways(label int) {
+	asm.emit(unix.BPF_JMP|unix.BPF_JA, 0, label, bpfNext)
+}
+
+func (asm *bpfAssembler) returnValue(value uint32) {
+	asm.emit(unix.BPF_RET|unix.BPF_K, value, bpfNext, bpfNext)
+}
+
+// Resolves labels into jump offsets
+func (asm *bpfAssembler) assemble() (program []unix.SockFilter, err error) {
+	if len(asm.instructions) > bpfMaxInstructions {
+		err = fmt.Errorf("capture filter needs %d BPF instructions (max %d), reduce the number of filter entries", len(asm.instructions), bpfMaxInstructions)
+		return
+	}
+
+	// Jump offset from instruction at index to label
+	offset := func(index int, label int) (jumpOffset int) {
+		if label == bpfNext {
+			return
+		}
+		jumpOffset = asm.labels[label] - index - 1
+		return
+	}
+
+	for index, instruction := range asm.instructions {
+		filter := instruction.filter
+
+		if filter.Code == unix.BPF_JMP|unix.BPF_JA {
+			filter.K = uint32(offset(index, instruction.jumpTrue))
+		} else if filter.Code&0x07 == unix.BPF_JMP {
+			jumpTrue, jumpFalse := offset(index, instruction.jumpTrue), offset(index, instruction.jumpFalse)
+			if jumpTrue < 0 || jumpTrue > 255 || jumpFalse < 0 || jumpFalse > 255 {
+				err = fmt.Errorf("capture filter jump out of range at instruction %d, reduce the number of filter entries", index)
+				return
+			}
+			filter.Jt, filter.Jf = uint8(jumpTrue), uint8(jumpFalse)
+		}
+
+		program = append(program, filter)
+	}
+	return
+}
@@ -0,0 +1,254 @@
+// wakeonlanpve
+package main
+
+import (
+	"encoding/binary"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// Every capture fixture in testdata
+var bpfTestFixtures = []string{
+	"ipv4-broadcast.pcap",
+	"ipv4-broadcast-vlan.pcap",
+	"ipv6-multicast.pcap",
+	"ipv6-multicast-vlan.pcap",
+	"ipv6-unicast.pcap",
+	"raw-ethernet.pcap",
+}
+
+// Runs program in a BPF VM, returning if the frame is accepted (and checking the whole frame would be kept)
+func runBPFProgram(t *testing.T, program []unix.SockFilter, frame []byte) (accepted bool) {
+	instructions := make([]bpf.Instruction, len(program))
+	for index, instruction := range program {
+		instructions[index] = bpf.RawInstruction{Op: instruction.Code, Jt: instruction.Jt, Jf: instruction.Jf, K: instruction.K}.Disassemble()
+	}
+
+	vm, err := bpf.NewVM(instructions)
+	if err != nil {
+		t.Fatalf("invalid BPF program: %v", err)
+	}
+
+	keptLength, err := vm.Run(frame)
+	if err != nil {
+		t.Fatalf("BPF program failed: %v", err)
+	}
+	if keptLength != 0 && keptLength < len(frame) {
+		t.Errorf("expected whole frame (%d bytes) to be kept, got %d bytes", len(frame), keptLength)
+	}
+
+	accepted = keptLength > 0
+	return
+}
+
+// Compiles parameters and returns the fixtures the program accepts
+func acceptedBPFFixtures(t *testing.T, params ListenInterfaceParams) (accepted []string) {
+	program, err := compileBPFFilter(params)
+	if err != nil {
+		t.Fatalf("unexpected compile error: %v", err)
+	}
+
+	for _, fixture := range bpfTestFixtures {
+		if runBPFProgram(t, program, readTestPacket(t, fixture).Data()) {
+			accepted = append(accepted, fixture)
+		}
+	}
+	sort.Strings(accepted)
+	return
+}
+
+func TestCompileBPFFilterFixtures(t *testing.T) {
+	tests := []struct {
+		name     string
+		params   ListenInterfaceParams
+		accepted []string
+	}{
+		{
+			"no filters",
+			ListenInterfaceParams{},
+			[]string{"ipv4-broadcast-vlan.pcap", "ipv4-broadcast.pcap", "ipv6-multicast-vlan.pcap", "ipv6-multicast.pcap", "ipv6-unicast.pcap"},
+		},
+		{
+			"raw ethernet",
+			ListenInterfaceParams{RawEthernetWOL: true},
+			[]string{"ipv4-broadcast-vlan.pcap", "ipv4-broadcast.pcap", "ipv6-multicast-vlan.pcap", "ipv6-multicast.pcap", "ipv6-unicast.pcap", "raw-ethernet.pcap"},
+		},
+		{
+			"IPv4 source and port",
+			ListenInterfaceParams{FilterSrcIP: []string{"192.168.1.10"}, FilterDstPort: "9"},
+			[]string{"ipv4-broadcast-vlan.pcap", "ipv4-broadcast.pcap"},
+		},
+		{
+			"IPv4 destination network",
+			ListenInterfaceParams{FilterDstIP: []string{"192.168.1.0/24"}},
+			[]string{"ipv4-broadcast-vlan.pcap", "ipv4-broadcast.pcap"},
+		},
+		{
+			"IPv6 link-local to all-nodes",
+			ListenInterfaceParams{FilterSrcIP: []string{"fe80::/10"}, FilterDstIP: []string{"ff02::1"}},
+			[]string{"ipv6-multicast-vlan.pcap", "ipv6-multicast.pcap"},
+		},
+		{
+			"IPv6 global unicast",
+			ListenInterfaceParams{FilterSrcIP: []string{"2001:db8:10::10"}, FilterDstIP: []string{"2001:db8:20::/64"}},
+			[]string{"ipv6-unicast.pcap"},
+		},
+		{
+			"mixed IP versions",
+			ListenInterfaceParams{FilterSrcIP: []string{"192.168.1.10", "2001:db8:10::/48"}},
+			[]string{"ipv4-broadcast-vlan.pcap", "ipv4-broadcast.pcap", "ipv6-unicast.pcap"},
+		},
+		{
+			"excluded link-local",
+			ListenInterfaceParams{FilterSrcIP: []string{"!fe80::/10"}},
+			[]string{"ipv4-broadcast-vlan.pcap", "ipv4-broadcast.pcap", "ipv6-unicast.pcap"},
+		},
+		{
+			"port range",
+			ListenInterfaceParams{FilterDstPort: "6-7"},
+			[]string{"ipv6-unicast.pcap"},
+		},
+		{
+			"excluded port",
+			ListenInterfaceParams{FilterDstPort: "!9"},
+			[]string{"ipv6-unicast.pcap"},
+		},
+		{
+			"source MAC with raw ethernet",
+			ListenInterfaceParams{FilterSrcMAC: []string{"00:50:56:11:22:44"}, RawEthernetWOL: true},
+			[]string{"ipv6-unicast.pcap"},
+		},
+		{
+			"excluded source MAC with raw ethernet",
+			ListenInterfaceParams{FilterSrcMAC: []string{"!00:50:56:11:22:44"}, RawEthernetWOL: true},
+			[]string{"ipv4-broadcast-vlan.pcap", "ipv4-broadcast.pcap", "ipv6-multicast-vlan.pcap", "ipv6-multicast.pcap", "raw-ethernet.pcap"},
+		},
+		{
+			"destination MAC",
+			ListenInterfaceParams{FilterDstMAC: []string{"ff:ff:ff:ff:ff:ff"}, RawEthernetWOL: true},
+			[]string{"ipv4-broadcast-vlan.pcap", "ipv4-broadcast.pcap", "raw-ethernet.pcap"},
+		},
+		{
+			"sync prefilter",
+			ListenInterfaceParams{KernelPrefilter: prefilterSync, RawEthernetWOL: true},
+			[]string{"ipv4-broadcast-vlan.pcap", "ipv4-broadcast.pcap", "ipv6-multicast-vlan.pcap", "ipv6-multicast.pcap", "ipv6-unicast.pcap", "raw-ethernet.pcap"},
+		},
+		{
+			"length prefilter",
+			ListenInterfaceParams{KernelPrefilter: prefilterLength},
+			[]string{"ipv4-broadcast-vlan.pcap", "ipv4-broadcast.pcap", "ipv6-multicast-vlan.pcap", "ipv6-multicast.pcap", "ipv6-unicast.pcap"},
+		},
+	}
+
+	for _, test := range tests {
+		accepted := acceptedBPFFixtures(t, test.params)
+		if strings.Join(accepted, ",") != strings.Join(test.accepted, ",") {
+			t.Errorf("%s: expected %v to be accepted, got %v", test.name, test.accepted, accepted)
+		}
+	}
+}
+
+func TestCompileBPFFilterPayloadPrefilter(t *testing.T) {
+	IPv4Frame := readTestPacket(t, "ipv4-broadcast.pcap").Data()
+	IPv6Frame := readTestPacket(t, "ipv6-multicast-vlan.pcap").Data()
+	rawFrame := readTestPacket(t, "raw-ethernet.pcap").Data()
+
+	// Payload offsets: Ethernet + IPv4 + UDP, Ethernet + 802.1Q + IPv6 + UDP, Ethernet
+	corrupt := func(frame []byte, offset int) (corrupted []byte) {
+		corrupted = append([]byte(nil), frame...)
+		corrupted[offset] = 0x00
+		return
+	}
+	corruptFrames := [][]byte{corrupt(IPv4Frame, 42), corrupt(IPv6Frame, 66), corrupt(rawFrame, 14)}
+
+	for _, mode := range []string{"", prefilterSync, prefilterLength} {
+		program, err := compileBPFFilter(ListenInterfaceParams{KernelPrefilter: mode, RawEthernetWOL: true})
+		if err != nil {
+			t.Fatalf("prefilter '%s': unexpected compile error: %v", mode, err)
+		}
+
+		for index, frame := range corruptFrames {
+			if runBPFProgram(t, program, frame) != (mode == "") {
+				t.Errorf("prefilter '%s': unexpected result for frame %d without sync stream", mode, index)
+			}
+		}
+	}
+
+	// Payload length outside the magic packet lengths only fails the length prefilter
+	truncatedFrame := append([]byte(nil), IPv4Frame[:len(IPv4Frame)-6]...)
+	binary.BigEndian.PutUint16(truncatedFrame[16:], binary.BigEndian.Uint16(truncatedFrame[16:])-6)
+	binary.BigEndian.PutUint16(truncatedFrame[38:], binary.BigEndian.Uint16(truncatedFrame[38:])-6)
+	for mode, expected := range map[string]bool{prefilterSync: true, prefilterLength: false} {
+		program, err := compileBPFFilter(ListenInterfaceParams{KernelPrefilter: mode})
+		if err != nil {
+			t.Fatalf("prefilter '%s': unexpected compile error: %v", mode, err)
+		}
+		if runBPFProgram(t, program, truncatedFrame) != expected {
+			t.Errorf("prefilter '%s': expected accepted=%v for 96 byte payload", mode, expected)
+		}
+	}
+}
+
+func TestCompileBPFFilterIPv4Header(t *testing.T) {
+	frame := readTestPacket(t, "ipv4-broadcast.pcap").Data()
+
+	// IPv4 options move the UDP header, which is found through the header length
+	withOptions := append(append(append([]byte(nil), frame[:34]...), 0x01, 0x01, 0x01, 0x00), frame[34:]...)
+	withOptions[14] = 0x46
+	binary.BigEndian.PutUint16(withOptions[16:], binary.BigEndian.Uint16(withOptions[16:])+4)
+
+	// Only the first fragment (more fragments flag set, offset 0) carries the UDP header
+	firstFragment := append([]byte(nil), frame...)
+	binary.BigEndian.PutUint16(firstFragment[20:], 0x2000)
+	fragment := append([]byte(nil), frame...)
+	binary.BigEndian.PutUint16(fragment[20:], 0x00b9)
+
+	program, err := compileBPFFilter(ListenInterfaceParams{FilterDstPort: "9", KernelPrefilter: prefilterLength})
+	if err != nil {
+		t.Fatalf("unexpected compile error: %v", err)
+	}
+
+	if !runBPFProgram(t, program, withOptions) {
+		t.Errorf("expected frame with IPv4 options to be accepted")
+	}
+	if !runBPFProgram(t, program, firstFragment) {
+		t.Errorf("expected first fragment to be accepted")
+	}
+	if runBPFProgram(t, program, fragment) {
+		t.Errorf("expected non-first fragment to be rejected")
+	}
+}
+
+func TestValidateAFPacketBackend(t *testing.T) {
+	invalid := []ListenInterfaceParams{
+		{RawFilter: "udp port 9"},
+		{RawFilter: "udp port 9", RawFilterMode: rawFilterAnd},
+		{FilterSrcIP: []string{"192.168.1.0/33"}},
+		{FilterSrcMAC: []string{"00:50:56:11:22"}},
+		{FilterDstPort: "9-7"},
+		{KernelPrefilter: "full"},
+		{KernelPrefilter: prefilterSync, ValidationMode: validationSearchPayload},
+	}
+
+	for _, params := range invalid {
+		params.CaptureBackend = captureBackendAFPacket
+		err := validateCaptureBackend(params)
+		if err == nil {
+			t.Errorf("expected error for %+v", params)
+		}
+	}
+
+	err := validateCaptureBackend(ListenInterfaceParams{CaptureBackend: captureBackendAFPacket, FilterSrcIP: []string{"fe80::/10"}, FilterDstPort: "7,9", KernelPrefilter: prefilterLength})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	err = validateCaptureBackend(ListenInterfaceParams{CaptureBackend: "pfring"})
+	if err == nil {
+		t.Errorf("expected error for unknown capture backend")
+	}
+}
@@ -0,0 +1,81 @@
+// wakeonlanpve
+package main
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+)
+
+// Live capture of a listen interface - packets are read through gopacket for every backend
+type captureSource interface {
+	gopacket.PacketDataSource
+	LinkType() (linkType layers.LinkType)
+	Stats() (stats captureStats, err error)
+	Close()
+}
+
+// Packet counters since the capture was opened
+type captureStats struct {
+	received         int // Passed the capture filter
+	dropped          int // Dropped by the kernel (buffer full)
+	interfaceDropped int // Dropped by the interface or driver
+}
+
+// Capture backend names for config
+const (
+	captureBackendPCAP     string = "pcap"     // libpcap (default when built with cgo)
+	captureBackendAFPacket string = "afpacket" // Linux AF_PACKET socket with a TPACKET_V3 ring, no libpcap
+)
+
+// Backend of the interface, defaulting to the one available in this build
+func captureBackend(PCAPParameters ListenInterfaceParams) (backend string) {
+	backend = PCAPParameters.CaptureBackend
+	if backend == "" {
+		backend = defaultCaptureBackend
+	}
+	return
+}
+
+// Ensures capture backend is known and its filter compiles with the interface filter options
+func validateCaptureBackend(PCAPParameters ListenInterfaceParams) (err error) {
+	err = validateFilterOptions(PCAPParameters)
+	if err != nil {
+		return
+	}
+
+	switch captureBackend(PCAPParameters) {
+	case captureBackendPCAP:
+		err = checkPCAPFilter(PCAPParameters)
+	case captureBackendAFPacket:
+		_, err = compileBPFFilter(PCAPParameters)
+	default:
+		err = fmt.Errorf("unknown capture backend '%s': must be '%s' or '%s'", PCAPParameters.CaptureBackend, captureBackendPCAP, captureBackendAFPacket)
+	}
+	return
+}
+
+// Opens live capture on the listen interface with the backend and filter from config
+func openCaptureSource(PCAPParameters ListenInterfaceParams) (source captureSource, err error) {
+	// Validated when config was loaded
+	PCAPfilter, _ := buildPCAPFilter(PCAPParameters)
+
+	if captureBackend(PCAPParameters) == captureBackendAFPacket {
+		var program []unix.SockFilter
+		program, err = compileBPFFilter(PCAPParameters)
+		if err != nil {
+			return
+		}
+
+		// Same packets as the libpcap expression, which is easier to read than the program
+		logMessage("Setting capture filter as %d BPF instruction(s) equivalent to '%s'", len(program), PCAPfilter)
+
+		source, err = openAFPacketCapture(PCAPParameters.ListenIntf, program, PCAPParameters.PromiscMode)
+		return
+	}
+
+	source, err = openPCAPCapture(PCAPParameters.ListenIntf, PCAPfilter, PCAPParameters.PromiscMode)
+	return
+}
@@ -0,0 +1,31 @@
+// wakeonlanpve
+
+//go:build !cgo
+
+package main
+
+import (
+	"fmt"
+)
+
+// Static builds without cgo have no libpcap, so interfaces capture with AF_PACKET unless configured otherwise
+const defaultCaptureBackend string = captureBackendAFPacket
+
+// Reported for anything that needs libpcap
+var errPCAPUnavailable error = fmt.Errorf("libpcap support is not included in this build (built without cgo), use capture backend '%s'", captureBackendAFPacket)
+
+func openPCAPCapture(listenIntf string, PCAPfilter string, promiscMode bool) (capture captureSource, err error) {
+	err = errPCAPUnavailable
+	return
+}
+
+// Capture files are filtered with libpcap expressions
+func openReplayCapture(replayFile string, PCAPParameters ListenInterfaceParams) (capture captureSource, err error) {
+	err = fmt.Errorf("replaying capture files requires libpcap, which is not included in this build (built without cgo)")
+	return
+}
+
+func checkPCAPFilter(PCAPParameters ListenInterfaceParams) (err error) {
+	err = errPCAPUnavailable
+	return
+}
@@ -0,0 +1,98 @@
+// wakeonlanpve
+
+//go:build cgo
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// libpcap is linked in, so it stays the default
+const defaultCaptureBackend string = captureBackendPCAP
+
+// ###################################
+//	LIBPCAP CAPTURE
+// ###################################
+
+// Capture through libpcap
+type pcapCapture struct {
+	*pcap.Handle
+}
+
+// Opens libpcap live capture and sets the filter expression
+func openPCAPCapture(listenIntf string, PCAPfilter string, promiscMode bool) (capture captureSource, err error) {
+	PCAPHandle, err := pcap.OpenLive(listenIntf, int32(captureSnapLen), promiscMode, pcap.BlockForever)
+	if err != nil {
+		err = fmt.Errorf("failed to open capture device: %v", err)
+		return
+	}
+
+	logMessage("Setting capture filter as '%s'", PCAPfilter)
+
+	err = PCAPHandle.SetBPFFilter(PCAPfilter)
+	if err != nil {
+		PCAPHandle.Close()
+		err = fmt.Errorf("failed to set BPF filter: %v", err)
+		return
+	}
+
+	capture = &pcapCapture{Handle: PCAPHandle}
+	return
+}
+
+// Opens saved capture file with the filter expression of the listen interface
+func openReplayCapture(replayFile string, PCAPParameters ListenInterfaceParams) (capture captureSource, err error) {
+	PCAPHandle, err := pcap.OpenOffline(replayFile)
+	if err != nil {
+		err = fmt.Errorf("failed to open capture file: %v", err)
+		return
+	}
+
+	// Validated when config was loaded
+	PCAPfilter, _ := buildPCAPFilter(PCAPParameters)
+
+	logMessage("Setting capture filter as '%s'", PCAPfilter)
+
+	err = PCAPHandle.SetBPFFilter(PCAPfilter)
+	if err != nil {
+		PCAPHandle.Close()
+		err = fmt.Errorf("failed to set BPF filter: %v", err)
+		return
+	}
+
+	capture = &pcapCapture{Handle: PCAPHandle}
+	return
+}
+
+// Ensures libpcap can compile the filter expression of the interface parameters
+func checkPCAPFilter(PCAPParameters ListenInterfaceParams) (err error) {
+	PCAPfilter, err := buildPCAPFilter(PCAPParameters)
+	if err != nil {
+		return
+	}
+
+	_, err = pcap.CompileBPFFilter(layers.LinkTypeEthernet, captureSnapLen, PCAPfilter)
+	if err != nil {
+		err = fmt.Errorf("capture filter '%s' does not compile: %v", PCAPfilter, err)
+		return
+	}
+	return
+}
+
+func (capture *pcapCapture) Stats() (stats captureStats, err error) {
+	PCAPStats, err := capture.Handle.Stats()
+	if err != nil {
+		return
+	}
+
+	stats = captureStats{
+		received:         PCAPStats.PacketsReceived,
+		dropped:          PCAPStats.PacketsDropped,
+		interfaceDropped: PCAPStats.PacketsIfDropped,
+	}
+	return
+}
@@ -0,0 +1,95 @@
+// wakeonlanpve
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Coalesces repeated wakes of the same guest within a cooldown window
+// WOL clients commonly send a burst of 3-5 magic packets (sometimes to several ports) for a single wake
+type wakeDebouncer struct {
+	mutex         sync.Mutex
+	defaultWindow time.Duration
+	guestWindows  map[string]time.Duration // Keyed by VMID
+	lastWake      map[string]time.Time     // Keyed by guest type/VMID
+	coalesced     map[string]int           // Wakes suppressed since the last executed wake
+}
+
+// Cooldown between wakes of the same guest if not set in config
+const defaultWakeCooldownSeconds int = 10
+
+// Creates debouncer from the global cooldown and per-guest overrides (in seconds)
+func newWakeDebouncer(defaultSeconds int, guestSeconds map[string]int) (debouncer *wakeDebouncer) {
+	debouncer = &wakeDebouncer{
+		defaultWindow: time.Duration(defaultSeconds) * time.Second,
+		guestWindows:  make(map[string]time.Duration),
+		lastWake:      make(map[string]time.Time),
+		coalesced:     make(map[string]int),
+	}
+
+	for VMID, seconds := range guestSeconds {
+		debouncer.guestWindows[VMID] = time.Duration(seconds) * time.Second
+	}
+	return
+}
+
+// Ensures cooldown values from config are usable
+func validateCooldowns(defaultSeconds *int, guestSeconds map[string]int) (err error) {
+	if defaultSeconds != nil && *defaultSeconds < 0 {
+		err = fmt.Errorf("wakeCooldownSeconds must not be negative")
+		return
+	}
+
+	for VMID, seconds := range guestSeconds {
+		if seconds < 0 {
+			err = fmt.Errorf("cooldown for guest %s must not be negative", VMID)
+			return
+		}
+	}
+	return
+}
+
+// Checks if a wake of the guest received at wakeTime should be executed, recording it if so
+// Packet capture time is used instead of the current time, so replayed captures are coalesced as they were live
+// When allowed, coalesced is the number of wakes suppressed since the previous executed wake
+// When not allowed, coalesced is the number of wakes suppressed so far in this window (including this one)
+func (debouncer *wakeDebouncer) allow(guest GuestConfig, wakeTime time.Time) (allowed bool, coalesced int, window time.Duration) {
+	debouncer.mutex.Lock()
+	defer debouncer.mutex.Unlock()
+
+	window, overridden := debouncer.guestWindows[guest.VMID]
+	if !overridden {
+		window = debouncer.defaultWindow
+	}
+
+	guestKey := guest.Type + "/" + guest.VMID
+
+	// Wake before the last one (clock stepped back, or out of order across interfaces) starts a new window
+	lastWake, seen := debouncer.lastWake[guestKey]
+	sinceLastWake := wakeTime.Sub(lastWake)
+	if seen && sinceLastWake >= 0 && sinceLastWake < window {
+		debouncer.coalesced[guestKey]++
+		coalesced = debouncer.coalesced[guestKey]
+		return
+	}
+
+	allowed = true
+	coalesced = debouncer.coalesced[guestKey]
+	debouncer.coalesced[guestKey] = 0
+	debouncer.lastWake[guestKey] = wakeTime
+	return
+}
+
+// Removes the wake recorded at wakeTime when it could not be executed (queue full), so retries are not coalesced
+func (debouncer *wakeDebouncer) cancel(guest GuestConfig, wakeTime time.Time) {
+	debouncer.mutex.Lock()
+	defer debouncer.mutex.Unlock()
+
+	// A previous wake within the window would have prevented this one, so nothing needs to be restored
+	guestKey := guest.Type + "/" + guest.VMID
+	if lastWake, seen := debouncer.lastWake[guestKey]; seen && lastWake.Equal(wakeTime) {
+		delete(debouncer.lastWake, guestKey)
+	}
+}
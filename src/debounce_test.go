@@ -0,0 +1,74 @@
+// wakeonlanpve
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWakeDebouncerUsesWakeTime(t *testing.T) {
+	debouncer := newWakeDebouncer(10, map[string]int{"105": 0})
+	guest := GuestConfig{VMID: "104", Type: "qemu-server"}
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		offset    time.Duration
+		allowed   bool
+		coalesced int
+	}{
+		{0, true, 0},
+		{time.Second, false, 1},
+		{3 * time.Second, false, 2},
+		{11 * time.Second, true, 2},
+		// Separate wake event minutes later, as in a replayed capture
+		{5 * time.Minute, true, 0},
+		{5*time.Minute + 9*time.Second, false, 1},
+		// Clock stepped back an hour, wake is executed instead of coalesced until the clock catches up
+		{-time.Hour, true, 1},
+		{-time.Hour + 2*time.Second, false, 1},
+	}
+
+	for _, test := range tests {
+		allowed, coalesced, window := debouncer.allow(guest, start.Add(test.offset))
+		if allowed != test.allowed || coalesced != test.coalesced {
+			t.Errorf("wake at offset %s: expected allowed=%v coalesced=%d, got allowed=%v coalesced=%d", test.offset, test.allowed, test.coalesced, allowed, coalesced)
+		}
+		if window != 10*time.Second {
+			t.Errorf("wake at offset %s: expected 10s window, got %s", test.offset, window)
+		}
+	}
+
+	// Guest override without cooldown
+	overrideGuest := GuestConfig{VMID: "105", Type: "qemu-server"}
+	for range 3 {
+		allowed, _, _ := debouncer.allow(overrideGuest, start)
+		if !allowed {
+			t.Errorf("expected every wake of guest without cooldown to be allowed")
+		}
+	}
+}
+
+func TestWakeDebouncerCancel(t *testing.T) {
+	debouncer := newWakeDebouncer(10, nil)
+	guest := GuestConfig{VMID: "104", Type: "qemu-server"}
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	allowed, _, _ := debouncer.allow(guest, start)
+	if !allowed {
+		t.Fatalf("expected first wake to be allowed")
+	}
+
+	// Wake could not be queued, so the retry within the window must not be coalesced
+	debouncer.cancel(guest, start)
+	allowed, _, _ = debouncer.allow(guest, start.Add(time.Second))
+	if !allowed {
+		t.Errorf("expected retry after cancelled wake to be allowed")
+	}
+
+	// Cancelling an older wake leaves the newer one in place
+	debouncer.cancel(guest, start)
+	allowed, _, _ = debouncer.allow(guest, start.Add(2*time.Second))
+	if allowed {
+		t.Errorf("expected wake within cooldown of the queued retry to be coalesced")
+	}
+}
@@ -0,0 +1,62 @@
+// wakeonlanpve
+package main
+
+import (
+	"sync"
+)
+
+// ###################################
+//	FAKE CONTROLLER
+// ###################################
+
+// Keeps guest power states in memory without touching any real guest
+// Every guest starts out stopped, and actions only change the recorded state
+type fakeController struct {
+	mutex  sync.Mutex
+	states map[string]GuestState
+}
+
+func newFakeController() (controller *fakeController) {
+	controller = &fakeController{states: make(map[string]GuestState)}
+	return
+}
+
+func (controller *fakeController) Status(guest GuestConfig) (state GuestState, err error) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	state, known := controller.states[guest.Type+"/"+guest.VMID]
+	if !known {
+		state = guestStopped
+	}
+	return
+}
+
+func (controller *fakeController) Start(guest GuestConfig) (err error) {
+	controller.setState(guest, guestRunning, "start")
+	return
+}
+
+func (controller *fakeController) Resume(guest GuestConfig) (err error) {
+	controller.setState(guest, guestRunning, "resume")
+	return
+}
+
+func (controller *fakeController) Wakeup(guest GuestConfig) (err error) {
+	controller.setState(guest, guestRunning, "wakeup")
+	return
+}
+
+func (controller *fakeController) Stop(guest GuestConfig) (err error) {
+	controller.setState(guest, guestStopped, "stop")
+	return
+}
+
+// Records new guest state and logs the action that would have been taken
+func (controller *fakeController) setState(guest GuestConfig, state GuestState, action string) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	controller.states[guest.Type+"/"+guest.VMID] = state
+	logMessage("Fake controller: %s %s %s - %s (now %s)", action, guestTypeName(guest.Type), guest.VMID, guest.Name, state)
+}
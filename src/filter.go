@@ -0,0 +1,299 @@
+// wakeonlanpve
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Capture length used for live captures (and filter compilation)
+const captureSnapLen int = 1600
+
+// Header lengths for payload offsets in the kernel prefilter
+const (
+	ethernetHeaderLength int = 14
+	dot1QTagLength       int = 4
+	udpHeaderLength      int = 8
+	ipv6HeaderLength     int = 40
+)
+
+// Kernel prefilter modes - how much of the magic packet payload is checked in the capture filter
+const (
+	prefilterSync   string = "sync"   // Payload starts with the 6 byte sync stream
+	prefilterLength string = "length" // Sync stream and a payload length the validation mode accepts
+)
+
+// How rawFilter is applied to the generated filter
+const (
+	rawFilterReplace string = "replace" // rawFilter is the whole capture filter (default)
+	rawFilterAnd     string = "and"     // Packets must match both the generated filter and rawFilter
+)
+
+// ###################################
+//	BUILD CAPTURE FILTER
+// ###################################
+
+// Creates BPF filter expression from listen interface parameters
+// Empty filter lists match any address, and entries prefixed with '!' are excluded
+func buildPCAPFilter(PCAPParameters ListenInterfaceParams) (PCAPfilter string, err error) {
+	// Used as is, including any 802.1Q handling
+	if PCAPParameters.RawFilter != "" && PCAPParameters.RawFilterMode != rawFilterAnd {
+		PCAPfilter = PCAPParameters.RawFilter
+		return
+	}
+
+	srcMACClause, err := buildFilterClause(PCAPParameters.FilterSrcMAC, "ether src", macFilterTerm)
+	if err != nil {
+		err = fmt.Errorf("filterSrcMAC: %v", err)
+		return
+	}
+	srcIPClause, err := buildFilterClause(PCAPParameters.FilterSrcIP, "src", ipFilterTerm)
+	if err != nil {
+		err = fmt.Errorf("filterSrcIP: %v", err)
+		return
+	}
+	dstIPClause, err := buildFilterClause(PCAPParameters.FilterDstIP, "dst", ipFilterTerm)
+	if err != nil {
+		err = fmt.Errorf("filterDstIP: %v", err)
+		return
+	}
+	dstMACClause, err := buildFilterClause(PCAPParameters.FilterDstMAC, "ether dst", macFilterTerm)
+	if err != nil {
+		err = fmt.Errorf("filterDstMAC: %v", err)
+		return
+	}
+	var dstPorts []string
+	if strings.TrimSpace(PCAPParameters.FilterDstPort) != "" {
+		dstPorts = strings.Split(PCAPParameters.FilterDstPort, ",")
+	}
+	dstPortClause, err := buildFilterClause(dstPorts, "dst", portFilterTerm)
+	if err != nil {
+		err = fmt.Errorf("filterDstPort: %v", err)
+		return
+	}
+
+	// Generated separately for untagged and 802.1Q tagged frames - "ether[]" offsets are not shifted by "vlan"
+	frameFilter := func(linkHeaderLength int) (frameFilter string) {
+		udpPrefilter, rawEthernetPrefilter := buildPrefilterClauses(PCAPParameters, linkHeaderLength)
+
+		frameFilter = joinFilterClauses("udp", srcMACClause, srcIPClause, dstIPClause, dstMACClause, dstPortClause, udpPrefilter)
+
+		// Also capture layer 2 WOL frames (no IP/UDP headers) from the allowed source MACs
+		if PCAPParameters.RawEthernetWOL {
+			rawEthernetFilter := joinFilterClauses(fmt.Sprintf("ether proto 0x%04x", uint16(etherTypeWOL)), srcMACClause, rawEthernetPrefilter)
+			frameFilter = fmt.Sprintf("(%s) or (%s)", frameFilter, rawEthernetFilter)
+		}
+
+		// Applied inside each half, so it sees the same offsets as the generated filter
+		if PCAPParameters.RawFilter != "" {
+			frameFilter = fmt.Sprintf("(%s) and (%s)", frameFilter, PCAPParameters.RawFilter)
+		}
+		return
+	}
+
+	// Match the same frames with an 802.1Q tag - "vlan" shifts offsets for every term after it, so it must come last
+	PCAPfilter = fmt.Sprintf("(%s) or (vlan and (%s))", frameFilter(ethernetHeaderLength), frameFilter(ethernetHeaderLength+dot1QTagLength))
+	return
+}
+
+// Ensures filter options of the interface parameters are consistent and build a filter expression
+// The capture backend then checks the filter compiles (libpcap or BPF compiled in Go)
+func validateFilterOptions(PCAPParameters ListenInterfaceParams) (err error) {
+	if PCAPParameters.RawFilterMode != "" && PCAPParameters.RawFilterMode != rawFilterReplace && PCAPParameters.RawFilterMode != rawFilterAnd {
+		err = fmt.Errorf("unknown rawFilterMode '%s': must be '%s' or '%s'", PCAPParameters.RawFilterMode, rawFilterReplace, rawFilterAnd)
+		return
+	}
+
+	switch PCAPParameters.KernelPrefilter {
+	case "", prefilterSync, prefilterLength:
+	default:
+		err = fmt.Errorf("unknown kernelPrefilter '%s': must be '%s' or '%s'", PCAPParameters.KernelPrefilter, prefilterSync, prefilterLength)
+		return
+	}
+
+	if PCAPParameters.KernelPrefilter != "" {
+		if PCAPParameters.ValidationMode == validationSearchPayload {
+			err = fmt.Errorf("kernelPrefilter cannot be used with validation mode '%s', which allows data before the magic packet", validationSearchPayload)
+			return
+		}
+		if PCAPParameters.RawFilter != "" && PCAPParameters.RawFilterMode != rawFilterAnd {
+			err = fmt.Errorf("kernelPrefilter cannot be used when rawFilter replaces the generated filter")
+			return
+		}
+	}
+
+	_, err = buildPCAPFilter(PCAPParameters)
+	return
+}
+
+// Creates payload checks for UDP and raw ethernet WOL frames, so other traffic is dropped before being copied to userspace
+// libpcap "udp[]" only works for IPv4, so IPv6 payload offsets assume UDP directly follows the IPv6 header (no extension headers)
+// Raw ethernet frames are padded to the minimum frame size, so only their sync stream is checked
+func buildPrefilterClauses(PCAPParameters ListenInterfaceParams, linkHeaderLength int) (udpPrefilter string, rawEthernetPrefilter string) {
+	if PCAPParameters.KernelPrefilter == "" {
+		return
+	}
+
+	ipv4Checks := []string{"ip", "udp[8:4] = 0xffffffff", "udp[12:2] = 0xffff"}
+	ipv6Checks := []string{"ip6", "ip6[6] = 17",
+		fmt.Sprintf("ip6[%d:4] = 0xffffffff", ipv6HeaderLength+udpHeaderLength),
+		fmt.Sprintf("ip6[%d:2] = 0xffff", ipv6HeaderLength+udpHeaderLength+4)}
+
+	if PCAPParameters.KernelPrefilter == prefilterLength {
+		ipv4Length := "udp[4:2]"
+		ipv6Length := fmt.Sprintf("ip6[%d:2]", ipv6HeaderLength+4)
+
+		if PCAPParameters.ValidationMode == validationAllowTrailing {
+			// Anything at least as long as a magic packet
+			ipv4Checks = append(ipv4Checks, fmt.Sprintf("%s >= %d", ipv4Length, udpHeaderLength+magicPacketLength))
+			ipv6Checks = append(ipv6Checks, fmt.Sprintf("%s >= %d", ipv6Length, udpHeaderLength+magicPacketLength))
+		} else {
+			// Magic packet with no, 4 byte, or 6 byte SecureOn password
+			var ipv4Lengths, ipv6Lengths []string
+			for _, passwordLength := range []int{0, 4, 6} {
+				ipv4Lengths = append(ipv4Lengths, fmt.Sprintf("%s = %d", ipv4Length, udpHeaderLength+magicPacketLength+passwordLength))
+				ipv6Lengths = append(ipv6Lengths, fmt.Sprintf("%s = %d", ipv6Length, udpHeaderLength+magicPacketLength+passwordLength))
+			}
+			ipv4Checks = append(ipv4Checks, "("+strings.Join(ipv4Lengths, " or ")+")")
+			ipv6Checks = append(ipv6Checks, "("+strings.Join(ipv6Lengths, " or ")+")")
+		}
+	}
+
+	udpPrefilter = fmt.Sprintf("((%s) or (%s))", strings.Join(ipv4Checks, " and "), strings.Join(ipv6Checks, " and "))
+	rawEthernetPrefilter = fmt.Sprintf("ether[%d:4] = 0xffffffff and ether[%d:2] = 0xffff", linkHeaderLength, linkHeaderLength+4)
+	return
+}
+
+// Creates one clause from a list of filter entries - any of the plain entries, and none of the '!' entries
+// Empty list results in an empty clause
+func buildFilterClause(entries []string, direction string, filterTerm func(direction string, entry string) (string, error)) (clause string, err error) {
+	includedEntries, excludedEntries := splitFilterEntries(entries)
+
+	var included, excluded []string
+	for _, entry := range includedEntries {
+		var term string
+		term, err = filterTerm(direction, entry)
+		if err != nil {
+			return
+		}
+		included = append(included, term)
+	}
+	for _, entry := range excludedEntries {
+		var term string
+		term, err = filterTerm(direction, entry)
+		if err != nil {
+			return
+		}
+		excluded = append(excluded, "not "+term)
+	}
+
+	var clauseParts []string
+	if len(included) > 0 {
+		clauseParts = append(clauseParts, "("+strings.Join(included, " or ")+")")
+	}
+	clauseParts = append(clauseParts, excluded...)
+	clause = strings.Join(clauseParts, " and ")
+	return
+}
+
+// Separates plain filter entries from '!' prefixed exclusions
+func splitFilterEntries(entries []string) (included []string, excluded []string) {
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+
+		if excludedEntry, negated := strings.CutPrefix(entry, "!"); negated {
+			excluded = append(excluded, strings.TrimSpace(excludedEntry))
+		} else {
+			included = append(included, entry)
+		}
+	}
+	return
+}
+
+// Joins non-empty clauses with "and"
+func joinFilterClauses(clauses ...string) (PCAPfilter string) {
+	var nonEmpty []string
+	for _, clause := range clauses {
+		if clause != "" {
+			nonEmpty = append(nonEmpty, clause)
+		}
+	}
+	PCAPfilter = strings.Join(nonEmpty, " and ")
+	return
+}
+
+// MAC address entry - "ether src 00:11:22:33:44:55"
+func macFilterTerm(direction string, entry string) (term string, err error) {
+	MAC, err := net.ParseMAC(entry)
+	if err != nil {
+		err = fmt.Errorf("invalid MAC address '%s'", entry)
+		return
+	}
+
+	term = direction + " " + MAC.String()
+	return
+}
+
+// IP address or CIDR entry - "src host 10.0.0.5" or "src net 10.0.0.0/24"
+func ipFilterTerm(direction string, entry string) (term string, err error) {
+	if strings.Contains(entry, "/") {
+		var network *net.IPNet
+		_, network, err = net.ParseCIDR(entry)
+		if err != nil {
+			err = fmt.Errorf("invalid CIDR '%s'", entry)
+			return
+		}
+
+		term = direction + " net " + network.String()
+		return
+	}
+
+	IP := net.ParseIP(entry)
+	if IP == nil {
+		err = fmt.Errorf("invalid IP address '%s'", entry)
+		return
+	}
+
+	term = direction + " host " + IP.String()
+	return
+}
+
+// Port or port range entry - "dst port 9" or "dst portrange 7-9"
+func portFilterTerm(direction string, entry string) (term string, err error) {
+	start, end, err := parsePortRange(entry)
+	if err != nil {
+		return
+	}
+
+	if start == end {
+		term = fmt.Sprintf("%s port %d", direction, start)
+	} else {
+		term = fmt.Sprintf("%s portrange %d-%d", direction, start, end)
+	}
+	return
+}
+
+// Parses a port ("9") or inclusive port range ("7-9")
+func parsePortRange(entry string) (start int, end int, err error) {
+	startPort, endPort, isRange := strings.Cut(entry, "-")
+
+	start, err = strconv.Atoi(startPort)
+	if err != nil || start < 1 || start > 65535 {
+		err = fmt.Errorf("invalid port '%s'", entry)
+		return
+	}
+
+	if !isRange {
+		end = start
+		return
+	}
+
+	end, err = strconv.Atoi(endPort)
+	if err != nil || end < start || end > 65535 {
+		err = fmt.Errorf("invalid port range '%s'", entry)
+		return
+	}
+	return
+}
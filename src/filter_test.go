@@ -0,0 +1,82 @@
+// wakeonlanpve
+
+//go:build cgo
+
+package main
+
+import (
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// Ensures the filter expressions are evaluated by libpcap, so match results mean something
+func requirePCAPFilterMatching(t *testing.T) {
+	tcpOnly, err := pcap.NewBPF(layers.LinkTypeEthernet, captureSnapLen, "tcp")
+	if err != nil {
+		t.Skipf("libpcap filter compilation not available: %v", err)
+	}
+
+	recvPacket := readTestPacket(t, "ipv6-multicast.pcap")
+	if tcpOnly.Matches(recvPacket.Metadata().CaptureInfo, recvPacket.Data()) {
+		t.Skip("linked pcap library does not evaluate filters")
+	}
+}
+
+func TestPCAPFilterMatchesIPv6Fixtures(t *testing.T) {
+	requirePCAPFilterMatching(t)
+
+	tests := []struct {
+		name    string
+		params  ListenInterfaceParams
+		matches map[string]bool // Fixture to expected match
+	}{
+		{
+			"any source",
+			ListenInterfaceParams{},
+			map[string]bool{"ipv6-multicast.pcap": true, "ipv6-multicast-vlan.pcap": true, "ipv6-unicast.pcap": true},
+		},
+		{
+			"link-local source to all-nodes",
+			ListenInterfaceParams{FilterSrcIP: []string{"fe80::/10"}, FilterDstIP: []string{"ff02::1"}, FilterDstPort: "9"},
+			map[string]bool{"ipv6-multicast.pcap": true, "ipv6-multicast-vlan.pcap": true, "ipv6-unicast.pcap": false},
+		},
+		{
+			"global unicast host",
+			ListenInterfaceParams{FilterSrcIP: []string{"2001:db8:10::10"}, FilterDstIP: []string{"2001:db8:20::/64"}},
+			map[string]bool{"ipv6-multicast.pcap": false, "ipv6-multicast-vlan.pcap": false, "ipv6-unicast.pcap": true},
+		},
+		{
+			"excluded link-local",
+			ListenInterfaceParams{FilterSrcIP: []string{"!fe80::/10"}, FilterDstPort: "7-9"},
+			map[string]bool{"ipv6-multicast.pcap": false, "ipv6-multicast-vlan.pcap": false, "ipv6-unicast.pcap": true},
+		},
+		{
+			"IPv4 only",
+			ListenInterfaceParams{FilterSrcIP: []string{"192.168.1.0/24"}},
+			map[string]bool{"ipv6-multicast.pcap": false, "ipv6-multicast-vlan.pcap": false, "ipv6-unicast.pcap": false},
+		},
+	}
+
+	for _, test := range tests {
+		PCAPfilter, err := buildPCAPFilter(test.params)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		filter, err := pcap.NewBPF(layers.LinkTypeEthernet, captureSnapLen, PCAPfilter)
+		if err != nil {
+			t.Errorf("%s: filter '%s' does not compile: %v", test.name, PCAPfilter, err)
+			continue
+		}
+
+		for fixture, expected := range test.matches {
+			recvPacket := readTestPacket(t, fixture)
+			if filter.Matches(recvPacket.Metadata().CaptureInfo, recvPacket.Data()) != expected {
+				t.Errorf("%s: expected match=%v for %s with filter '%s'", test.name, expected, fixture, PCAPfilter)
+			}
+		}
+	}
+}
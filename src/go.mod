@@ -4,7 +4,7 @@ go 1.24.5
 
 require (
 	github.com/google/gopacket v1.1.19
+	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
+	golang.org/x/sys v0.34.0
 	golang.org/x/term v0.33.0
 )
-
-require golang.org/x/sys v0.34.0 // indirect
@@ -74,6 +74,8 @@ profile WOLPVE @{exelocation} flags=(enforce) {
   capability net_raw,
   network inet dgram,
   network inet6 dgram,
+  network inet stream,
+  network inet6 stream,
   network netlink raw,
   network packet raw,
 
@@ -83,11 +85,19 @@ profile WOLPVE @{exelocation} flags=(enforce) {
   # Allow execution of virtual machine cmd commands
   /usr/sbin/qm rmUx,
   /usr/sbin/pct rmUx,
+  /usr/bin/lxc-info rmUx,
+  /usr/bin/virsh rmUx,
+
+  # QEMU monitor sockets for waking guests suspended to RAM
+  unix (connect, send, receive) type=stream,
+  /{,var/}run/qemu-server/*.qmp rw,
 
   # etc access
   /etc/ld.so.cache r,
   /etc/pve/nodes/*/qemu-server/{,*} r,
   /etc/pve/nodes/*/lxc/{,*} r,
+  /etc/libvirt/qemu/{,*} r,
+  /etc/pve/user.cfg r,
   ` + defaultVMConfPaths + `/* r,
   ` + defaultLXCConfPaths + `/* r,
 
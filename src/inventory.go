@@ -0,0 +1,396 @@
+// wakeonlanpve
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// In-memory index of guest NIC MAC addresses, kept current from filesystem change notifications
+type GuestInventory struct {
+	mutex       sync.RWMutex
+	configPaths []string
+	byMAC       map[string][]GuestConfig
+	byPath      map[string]GuestConfig
+	lastRescan  time.Time
+	duplicates  string // Last reported duplicate MAC summary
+}
+
+// Creates an empty inventory for the given config directories
+func newGuestInventory(configPaths []string) (inventory *GuestInventory) {
+	inventory = &GuestInventory{
+		configPaths: configPaths,
+		byMAC:       make(map[string][]GuestConfig),
+		byPath:      make(map[string]GuestConfig),
+	}
+	return
+}
+
+// ###################################
+//	INVENTORY LOOKUP
+// ###################################
+
+// Retrieves the guests owning a MAC address (more than one if the MAC is duplicated), sorted by VMID
+func (inventory *GuestInventory) lookup(MACAddress string) (guests []GuestConfig, found bool) {
+	inventory.mutex.RLock()
+	defer inventory.mutex.RUnlock()
+
+	guests, found = inventory.byMAC[MACAddress]
+	return
+}
+
+// ###################################
+//	INVENTORY UPDATES
+// ###################################
+
+// Rebuilds the entire inventory from the config directories
+func (inventory *GuestInventory) rescan() (err error) {
+	guests, err := readGuestConfigs(inventory.configPaths)
+	if err != nil {
+		return
+	}
+
+	byPath := make(map[string]GuestConfig)
+	for _, guest := range guests {
+		byPath[guest.ConfigPath] = guest
+	}
+
+	inventory.mutex.Lock()
+	inventory.byPath = byPath
+	inventory.rebuildMACIndex()
+	inventory.lastRescan = time.Now()
+	macCount := len(inventory.byMAC)
+	inventory.mutex.Unlock()
+
+	logMessage("Guest inventory loaded %d MAC address(es) from %d config file(s)", macCount, len(guests))
+
+	// Periodic rescans only warn when the set of duplicates changed
+	inventory.reportDuplicates(false)
+	return
+}
+
+// Re-reads a single config file after a change notification (removing it if it no longer exists)
+func (inventory *GuestInventory) refreshFile(configFilePath string) {
+	_, err := os.Stat(configFilePath)
+	if os.IsNotExist(err) {
+		inventory.mutex.Lock()
+		delete(inventory.byPath, configFilePath)
+		inventory.rebuildMACIndex()
+		inventory.mutex.Unlock()
+
+		inventory.reportDuplicates(true)
+		return
+	}
+
+	// Unreadable configs keep their previous entry until the next successful read
+	guest, err := readGuestConfig(configFilePath)
+	if err != nil {
+		logMessage("Error refreshing guest inventory:%v", err)
+		return
+	}
+
+	inventory.mutex.Lock()
+	inventory.byPath[configFilePath] = guest
+	inventory.rebuildMACIndex()
+	inventory.mutex.Unlock()
+
+	inventory.reportDuplicates(true)
+}
+
+// Recreates the MAC index from the per-file guest configs - caller must hold write lock
+func (inventory *GuestInventory) rebuildMACIndex() {
+	byMAC := make(map[string][]GuestConfig)
+	for _, guest := range inventory.byPath {
+		// Same MAC on two NICs of one guest is not a duplicate across guests
+		guestMACs := make(map[string]bool)
+		for _, nic := range guest.NICs {
+			if nic.MACAddress == "" || guestMACs[nic.MACAddress] {
+				continue
+			}
+			guestMACs[nic.MACAddress] = true
+			byMAC[nic.MACAddress] = append(byMAC[nic.MACAddress], guest)
+		}
+	}
+
+	for MACAddress := range byMAC {
+		sortGuestsByVMID(byMAC[MACAddress])
+	}
+
+	inventory.byMAC = byMAC
+}
+
+// ###################################
+//	DUPLICATE MACS
+// ###################################
+
+// Duplicate MAC handling policies
+const (
+	duplicatePolicyRefuse string = "refuse" // Do not start any guest sharing the MAC
+	duplicatePolicyAll    string = "all"    // Start every guest sharing the MAC
+	duplicatePolicyLowest string = "lowest" // Start only the guest with the lowest VMID
+)
+
+// Ensures duplicate MAC policy from config is known - empty means refuse
+func validateDuplicatePolicy(policy string) (err error) {
+	switch policy {
+	case "", duplicatePolicyRefuse, duplicatePolicyAll, duplicatePolicyLowest:
+	default:
+		err = fmt.Errorf("unknown duplicate MAC policy '%s': must be '%s', '%s', or '%s'", policy, duplicatePolicyRefuse, duplicatePolicyAll, duplicatePolicyLowest)
+	}
+	return
+}
+
+// Applies the duplicate MAC policy to the guests sharing a MAC address (guests must be sorted by VMID)
+func applyDuplicatePolicy(guests []GuestConfig, policy string) (selected []GuestConfig, err error) {
+	if len(guests) < 2 {
+		selected = guests
+		return
+	}
+
+	switch policy {
+	case duplicatePolicyAll:
+		selected = guests
+	case duplicatePolicyLowest:
+		selected = guests[:1]
+	default:
+		err = fmt.Errorf("MAC address is shared by multiple guests (%s), refusing to start any of them", describeGuests(guests))
+	}
+	return
+}
+
+// Logs every MAC shared by more than one guest
+// Unless forced, nothing is logged when the duplicates are the same as the last report
+func (inventory *GuestInventory) reportDuplicates(force bool) {
+	inventory.mutex.Lock()
+	defer inventory.mutex.Unlock()
+
+	var MACAddresses []string
+	for MACAddress, guests := range inventory.byMAC {
+		if len(guests) > 1 {
+			MACAddresses = append(MACAddresses, MACAddress)
+		}
+	}
+	sort.Strings(MACAddresses)
+
+	var warnings []string
+	for _, MACAddress := range MACAddresses {
+		warnings = append(warnings, fmt.Sprintf("Warning: duplicate MAC address %s found in guests %s", MACAddress, describeGuests(inventory.byMAC[MACAddress])))
+	}
+
+	summary := strings.Join(warnings, "\n")
+	if !force && summary == inventory.duplicates {
+		return
+	}
+	inventory.duplicates = summary
+
+	for _, warning := range warnings {
+		logMessage("%s", warning)
+	}
+}
+
+// Formats guest list as "104 (web01), 105 (web02)"
+func describeGuests(guests []GuestConfig) (description string) {
+	var guestNames []string
+	for _, guest := range guests {
+		guestNames = append(guestNames, fmt.Sprintf("%s (%s)", guest.VMID, guest.Name))
+	}
+	description = strings.Join(guestNames, ", ")
+	return
+}
+
+// Sorts guests by numeric VMID (non-numeric IDs sort after numeric ones, by name)
+func sortGuestsByVMID(guests []GuestConfig) {
+	sort.Slice(guests, func(i, j int) bool {
+		firstID, firstErr := strconv.Atoi(guests[i].VMID)
+		secondID, secondErr := strconv.Atoi(guests[j].VMID)
+		if firstErr == nil && secondErr == nil {
+			return firstID < secondID
+		} else if firstErr == nil || secondErr == nil {
+			return firstErr == nil
+		}
+		return guests[i].VMID < guests[j].VMID
+	})
+}
+
+// ###################################
+//	INVENTORY WATCHER
+// ###################################
+
+// Watches config directories for changes using inotify, and periodically rescans everything as a fallback
+// The rescan is required for /etc/pve (pmxcfs), which does not emit inotify events for changes made on other nodes
+func (inventory *GuestInventory) watch(rescanInterval time.Duration) {
+	// Recover from panic
+	defer func() {
+		if r := recover(); r != nil {
+			logError("panic while watching guest configs", fmt.Errorf("%v", r), false)
+		}
+	}()
+
+	rescanTicker := time.NewTicker(rescanInterval)
+	defer rescanTicker.Stop()
+
+	changedFiles, err := inventory.watchConfigPaths()
+	if err != nil {
+		logMessage("Unable to watch VM config paths for changes (falling back to rescan every %s): %v", rescanInterval, err)
+	}
+
+	for {
+		select {
+		case configFilePath := <-changedFiles:
+			if configFilePath == "" {
+				// Events were lost, nothing to do but read everything again
+				err = inventory.rescan()
+				if err != nil {
+					logMessage("Error rescanning guest inventory: %v", err)
+				}
+				continue
+			}
+			inventory.refreshFile(configFilePath)
+		case <-rescanTicker.C:
+			err = inventory.rescan()
+			if err != nil {
+				logMessage("Error rescanning guest inventory: %v", err)
+			}
+		}
+	}
+}
+
+// Adds inotify watches on every config directory and sends the path of each changed config file to the channel
+// An empty path is sent when the kernel event queue overflowed
+func (inventory *GuestInventory) watchConfigPaths() (changedFiles chan string, err error) {
+	inotifyFD, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		err = fmt.Errorf("failed to initialize inotify: %v", err)
+		return
+	}
+
+	const watchMask uint32 = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM | unix.IN_DELETE | unix.IN_CREATE
+
+	// Watch descriptor to directory path
+	watchedDirs := make(map[int]string)
+	for _, configPath := range inventory.configPaths {
+		watchDescriptor, watchErr := unix.InotifyAddWatch(inotifyFD, configPath, watchMask)
+		if watchErr != nil {
+			unix.Close(inotifyFD)
+			err = fmt.Errorf("failed to watch %s: %v", configPath, watchErr)
+			return
+		}
+		watchedDirs[watchDescriptor] = configPath
+	}
+
+	changedFiles = make(chan string, 64)
+	go readInotifyEvents(inotifyFD, watchedDirs, changedFiles)
+	return
+}
+
+// Reads raw inotify events from the file descriptor and converts them to changed config file paths
+func readInotifyEvents(inotifyFD int, watchedDirs map[int]string, changedFiles chan string) {
+	defer unix.Close(inotifyFD)
+
+	eventBuffer := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		bytesRead, err := unix.Read(inotifyFD, eventBuffer)
+		if err == unix.EINTR {
+			continue
+		} else if err != nil {
+			logMessage("Error reading VM config change notifications: %v", err)
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= bytesRead; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&eventBuffer[offset]))
+			nameBytes := eventBuffer[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)]
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+
+			if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+				changedFiles <- ""
+				continue
+			}
+
+			fileName := strings.TrimRight(string(nameBytes), "\x00")
+			configPath, watched := watchedDirs[int(event.Wd)]
+			if !watched || !isGuestConfigFile(fileName) {
+				continue
+			}
+
+			changedFiles <- filepath.Join(configPath, fileName)
+		}
+	}
+}
+
+// ###################################
+//	INVENTORY DUMP
+// ###################################
+
+// Formats every MAC in the inventory with its guest and NIC details, sorted by MAC
+func (inventory *GuestInventory) dump() (inventoryText string) {
+	inventory.mutex.RLock()
+	defer inventory.mutex.RUnlock()
+
+	var MACAddresses []string
+	for MACAddress := range inventory.byMAC {
+		MACAddresses = append(MACAddresses, MACAddress)
+	}
+	sort.Strings(MACAddresses)
+
+	var lines []string
+	lines = append(lines, fmt.Sprintf("Guest inventory: %d MAC address(es), last full rescan %s", len(MACAddresses), inventory.lastRescan.Format("2006-01-02 15:04:05")))
+	for _, MACAddress := range MACAddresses {
+		guests := inventory.byMAC[MACAddress]
+		for _, guest := range guests {
+			nic, _ := guest.findNIC(MACAddress)
+			line := fmt.Sprintf("  %s -> %s %s (%s) %s bridge=%s tag=%d firewall=%t link_down=%t",
+				MACAddress, guest.Type, guest.VMID, guest.Name, nic.Key, nic.Bridge, nic.VLANTag, nic.Firewall, nic.LinkDown)
+			if len(guest.Tags) > 0 {
+				line += " tags=" + strings.Join(guest.Tags, ";")
+			}
+			if len(guests) > 1 {
+				line += " [DUPLICATE]"
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	inventoryText = strings.Join(lines, "\n")
+	return
+}
+
+// Logs the inventory every time SIGUSR1 is received
+func (inventory *GuestInventory) dumpOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	for range signals {
+		for _, line := range strings.Split(inventory.dump(), "\n") {
+			logMessage("%s", line)
+		}
+	}
+}
+
+// Builds the inventory from the config file paths and prints it
+func showInventory(configFile string) (err error) {
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return
+	}
+
+	inventory := newGuestInventory(config.VMConfigPaths)
+	err = inventory.rescan()
+	if err != nil {
+		return
+	}
+
+	fmt.Println(inventory.dump())
+	return
+}
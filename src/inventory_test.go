@@ -0,0 +1,174 @@
+// wakeonlanpve
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Builds an in-memory inventory from guests, without reading any config files
+func newTestInventory(guests ...GuestConfig) (inventory *GuestInventory) {
+	inventory = newGuestInventory(nil)
+	for _, guest := range guests {
+		inventory.byPath[guest.ConfigPath] = guest
+	}
+	inventory.rebuildMACIndex()
+	return
+}
+
+// Guest with one NIC per MAC address, all on the given bridge and VLAN
+func newTestGuest(VMID string, name string, bridge string, VLANTag int, MACAddresses ...string) (guest GuestConfig) {
+	guest = GuestConfig{VMID: VMID, Type: "qemu-server", Name: name, ConfigPath: "/etc/pve/qemu-server/" + VMID + ".conf"}
+	for index, MACAddress := range MACAddresses {
+		guest.NICs = append(guest.NICs, GuestNIC{Key: "net" + strconv.Itoa(index), Model: "virtio", MACAddress: MACAddress, Bridge: bridge, VLANTag: VLANTag})
+	}
+	return
+}
+
+// VMIDs of guests in order
+func guestVMIDs(guests []GuestConfig) (VMIDs string) {
+	var IDs []string
+	for _, guest := range guests {
+		IDs = append(IDs, guest.VMID)
+	}
+	VMIDs = strings.Join(IDs, ",")
+	return
+}
+
+func TestInventoryDuplicateIndex(t *testing.T) {
+	inventory := newTestInventory(
+		newTestGuest("1000", "web03", "vmbr0", 0, "BC:24:11:00:00:01"),
+		newTestGuest("104", "web01", "vmbr0", 0, "BC:24:11:00:00:01"),
+		newTestGuest("105", "web02", "vmbr1", 0, "BC:24:11:00:00:01"),
+		// Same MAC on two NICs of one guest
+		newTestGuest("200", "router", "vmbr0", 0, "BC:24:11:00:00:02", "BC:24:11:00:00:02"),
+	)
+
+	guests, found := inventory.lookup("BC:24:11:00:00:01")
+	if !found || guestVMIDs(guests) != "104,105,1000" {
+		t.Errorf("expected duplicate MAC guests sorted by numeric VMID (104,105,1000), got %s", guestVMIDs(guests))
+	}
+
+	guests, found = inventory.lookup("BC:24:11:00:00:02")
+	if !found || guestVMIDs(guests) != "200" {
+		t.Errorf("expected MAC on two NICs of one guest to belong only to 200, got %s", guestVMIDs(guests))
+	}
+
+	inventory.reportDuplicates(true)
+	if !strings.Contains(inventory.duplicates, "BC:24:11:00:00:01 found in guests 104 (web01), 105 (web02), 1000 (web03)") {
+		t.Errorf("expected duplicate report for BC:24:11:00:00:01, got '%s'", inventory.duplicates)
+	}
+	if strings.Contains(inventory.duplicates, "BC:24:11:00:00:02") {
+		t.Errorf("expected MAC shared by NICs of one guest not to be reported, got '%s'", inventory.duplicates)
+	}
+}
+
+func TestMatchMACDuplicatePolicies(t *testing.T) {
+	inventory := newTestInventory(
+		newTestGuest("105", "web02", "vmbr0", 0, "BC:24:11:00:00:01"),
+		newTestGuest("104", "web01", "vmbr0", 0, "BC:24:11:00:00:01"),
+		newTestGuest("300", "single", "vmbr0", 0, "BC:24:11:00:00:03"),
+	)
+
+	tests := []struct {
+		policy        string
+		MACAddress    string
+		expectedVMIDs string
+		expectedError string
+	}{
+		{"", "BC:24:11:00:00:01", "", "shared by multiple guests (104 (web01), 105 (web02))"},
+		{duplicatePolicyRefuse, "BC:24:11:00:00:01", "", "refusing to start any of them"},
+		{duplicatePolicyAll, "BC:24:11:00:00:01", "104,105", ""},
+		{duplicatePolicyLowest, "BC:24:11:00:00:01", "104", ""},
+		// Policy does not apply to MACs owned by a single guest
+		{duplicatePolicyRefuse, "BC:24:11:00:00:03", "300", ""},
+		{duplicatePolicyRefuse, "BC:24:11:00:00:99", "", ""},
+	}
+
+	for _, test := range tests {
+		guests, err := matchMACtoVM(test.MACAddress, bridgeScope{}, inventory, test.policy)
+		if test.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+				t.Errorf("policy '%s' MAC %s: expected error containing '%s', got: %v", test.policy, test.MACAddress, test.expectedError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("policy '%s' MAC %s: unexpected error: %v", test.policy, test.MACAddress, err)
+			continue
+		}
+		if guestVMIDs(guests) != test.expectedVMIDs {
+			t.Errorf("policy '%s' MAC %s: expected guests '%s', got '%s'", test.policy, test.MACAddress, test.expectedVMIDs, guestVMIDs(guests))
+		}
+	}
+}
+
+func TestMatchMACBridgeScopeDisambiguates(t *testing.T) {
+	inventory := newTestInventory(
+		newTestGuest("104", "web01", "vmbr0", 0, "BC:24:11:00:00:01"),
+		newTestGuest("105", "web02", "vmbr1", 20, "BC:24:11:00:00:01"),
+		newTestGuest("106", "web03", "vmbr1", 30, "BC:24:11:00:00:01"),
+	)
+
+	tests := []struct {
+		listenIntf    string
+		matchVLANTag  bool
+		expectedVMIDs string
+		expectedError string
+	}{
+		// Only one guest on the listener bridge, so the duplicate is resolved even with the refuse policy
+		{"vmbr0", false, "104", ""},
+		// Both vmbr1 guests are in scope without the VLAN check
+		{"vmbr1", false, "", "shared by multiple guests (105 (web02), 106 (web03))"},
+		{"vmbr1.20", true, "105", ""},
+		{"vmbr1v30", true, "106", ""},
+		{"vmbr2", false, "", "which is not on bridge vmbr2"},
+		{"vmbr1.40", true, "", "which is not on bridge vmbr1 VLAN 40"},
+	}
+
+	for _, test := range tests {
+		scope, err := newBridgeScope(ListenInterfaceParams{ListenIntf: test.listenIntf, MatchBridge: true, MatchVLANTag: test.matchVLANTag})
+		if err != nil {
+			t.Fatalf("%s: unexpected scope error: %v", test.listenIntf, err)
+		}
+
+		guests, err := matchMACtoVM("BC:24:11:00:00:01", scope, inventory, duplicatePolicyRefuse)
+		if test.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+				t.Errorf("%s: expected error containing '%s', got: %v", test.listenIntf, test.expectedError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.listenIntf, err)
+			continue
+		}
+		if guestVMIDs(guests) != test.expectedVMIDs {
+			t.Errorf("%s: expected guests '%s', got '%s'", test.listenIntf, test.expectedVMIDs, guestVMIDs(guests))
+		}
+	}
+}
+
+func TestMatchMACPacketVLANScope(t *testing.T) {
+	inventory := newTestInventory(
+		newTestGuest("105", "web02", "vmbr1", 20, "BC:24:11:00:00:01"),
+		newTestGuest("106", "web03", "vmbr1", 0, "BC:24:11:00:00:01"),
+	)
+
+	scope, err := newBridgeScope(ListenInterfaceParams{ListenIntf: "vmbr1", MatchBridge: true, MatchPacketVLAN: true})
+	if err != nil {
+		t.Fatalf("unexpected scope error: %v", err)
+	}
+
+	for VLAN, expectedVMIDs := range map[int]string{20: "105", 0: "106"} {
+		guests, err := matchMACtoVM("BC:24:11:00:00:01", scope.forPacket(VLAN), inventory, duplicatePolicyRefuse)
+		if err != nil {
+			t.Errorf("packet VLAN %d: unexpected error: %v", VLAN, err)
+			continue
+		}
+		if guestVMIDs(guests) != expectedVMIDs {
+			t.Errorf("packet VLAN %d: expected guests '%s', got '%s'", VLAN, expectedVMIDs, guestVMIDs(guests))
+		}
+	}
+}
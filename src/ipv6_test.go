@@ -0,0 +1,146 @@
+// wakeonlanpve
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// Reads the single packet of a capture fixture in testdata
+func readTestPacket(t *testing.T, fixture string) (recvPacket gopacket.Packet) {
+	captureFile, err := os.Open(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatalf("failed to open fixture: %v", err)
+	}
+	defer captureFile.Close()
+
+	reader, err := pcapgo.NewReader(captureFile)
+	if err != nil {
+		t.Fatalf("failed to read fixture %s: %v", fixture, err)
+	}
+
+	data, captureInfo, err := reader.ReadPacketData()
+	if err != nil {
+		t.Fatalf("failed to read packet from fixture %s: %v", fixture, err)
+	}
+
+	recvPacket = gopacket.NewPacket(data, reader.LinkType(), gopacket.Default)
+	recvPacket.Metadata().CaptureInfo = captureInfo
+	return
+}
+
+// IPv6 WOL fixtures: link-local sender to all-nodes multicast (untagged and VLAN 20), and global unicast with a SecureOn password
+var ipv6Fixtures = []struct {
+	fixture          string
+	MACAddress       string
+	SecureOnPassword string
+	sender           string
+	destination      string
+}{
+	{"ipv6-multicast.pcap", "BC:24:11:00:00:01", "", "fe80::250:56ff:fe11:2233%vmbr0 (00:50:56:11:22:33)", "ff02::1%vmbr0 (multicast)"},
+	{"ipv6-multicast-vlan.pcap", "BC:24:11:00:00:01", "", "fe80::250:56ff:fe11:2233%vmbr0 (00:50:56:11:22:33) on VLAN 20", "ff02::1%vmbr0 (multicast)"},
+	{"ipv6-unicast.pcap", "BC:24:11:00:00:02", "01:02:03:04:05:06", "2001:db8:10::10 (00:50:56:11:22:44)", "2001:db8:20::20"},
+}
+
+func TestValidateIPv6Packets(t *testing.T) {
+	for _, test := range ipv6Fixtures {
+		recvPacket := readTestPacket(t, test.fixture)
+
+		MACAddress, SecureOnPassword, err := validatePacket(recvPacket, validationStrict)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.fixture, err)
+			continue
+		}
+		if MACAddress != test.MACAddress || SecureOnPassword != test.SecureOnPassword {
+			t.Errorf("%s: expected MAC %s password '%s', got MAC %s password '%s'", test.fixture, test.MACAddress, test.SecureOnPassword, MACAddress, SecureOnPassword)
+		}
+	}
+}
+
+func TestIPv6WakeSource(t *testing.T) {
+	for _, test := range ipv6Fixtures {
+		source := newWakeSource("vmbr0", readTestPacket(t, test.fixture))
+
+		if source.String() != test.sender {
+			t.Errorf("%s: expected sender '%s', got '%s'", test.fixture, test.sender, source)
+		}
+		if source.destination() != test.destination {
+			t.Errorf("%s: expected destination '%s', got '%s'", test.fixture, test.destination, source.destination())
+		}
+		if source.Received.Unix() != 1700000000 {
+			t.Errorf("%s: expected capture timestamp, got %s", test.fixture, source.Received)
+		}
+	}
+}
+
+func TestIPv6WakePolicySource(t *testing.T) {
+	policy, err := newWakePolicy([]WakePolicyRule{
+		{SourceIPs: []string{"fe80::/10"}, TargetVMIDs: []string{"104"}},
+		{SourceIPs: []string{"2001:db8:10::10"}, TargetVMIDs: []string{"105"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	multicastSource := newWakeSource("vmbr0", readTestPacket(t, "ipv6-multicast.pcap"))
+	unicastSource := newWakeSource("vmbr0", readTestPacket(t, "ipv6-unicast.pcap"))
+	web01 := GuestConfig{VMID: "104", Type: "qemu-server", Name: "web01"}
+	web02 := GuestConfig{VMID: "105", Type: "qemu-server", Name: "web02"}
+
+	if err = policy.authorize(multicastSource, web01); err != nil {
+		t.Errorf("expected link-local sender to wake 104: %v", err)
+	}
+	if err = policy.authorize(multicastSource, web02); err == nil {
+		t.Errorf("expected link-local sender to be denied for 105")
+	}
+	if err = policy.authorize(unicastSource, web02); err != nil {
+		t.Errorf("expected global unicast sender to wake 105: %v", err)
+	}
+	if err = policy.authorize(unicastSource, web01); err == nil {
+		t.Errorf("expected global unicast sender to be denied for 104")
+	}
+}
+
+func TestBuildPCAPFilterIPv6Entries(t *testing.T) {
+	PCAPfilter, err := buildPCAPFilter(ListenInterfaceParams{
+		ListenIntf:    "vmbr0",
+		FilterSrcIP:   []string{"fe80::/10", "2001:db8:10::10", "!2001:db8:10::/64"},
+		FilterDstIP:   []string{"ff02::1", "2001:DB8:20::20", "192.168.1.255"},
+		FilterDstPort: "7,9",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, term := range []string{
+		"src net fe80::/10",
+		"src host 2001:db8:10::10",
+		"not src net 2001:db8:10::/64",
+		"dst host ff02::1",
+		"dst host 2001:db8:20::20",
+		"dst host 192.168.1.255",
+	} {
+		if !strings.Contains(PCAPfilter, term) {
+			t.Errorf("expected '%s' in filter: %s", term, PCAPfilter)
+		}
+	}
+
+	// Same clauses for tagged frames
+	untagged, tagged, found := strings.Cut(PCAPfilter, " or (vlan and (")
+	if !found || !strings.HasPrefix(tagged, strings.TrimPrefix(untagged, "(")) {
+		t.Errorf("expected identical clauses for untagged and tagged frames: %s", PCAPfilter)
+	}
+
+	// Invalid v6 entries are reported
+	for _, entry := range []string{"fe80::/129", "2001:db8::zz", "fe80::1%vmbr0"} {
+		_, err = buildPCAPFilter(ListenInterfaceParams{FilterSrcIP: []string{entry}})
+		if err == nil {
+			t.Errorf("expected error for filterSrcIP entry '%s'", entry)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// wakeonlanpve
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Guest type for libvirt domains (VMID is the domain name)
+const guestTypeLibvirt string = "libvirt"
+
+// Subset of libvirt domain XML needed for the MAC inventory
+type libvirtDomain struct {
+	Name       string             `xml:"name"`
+	Interfaces []libvirtInterface `xml:"devices>interface"`
+}
+
+type libvirtInterface struct {
+	Type string `xml:"type,attr"`
+	MAC  struct {
+		Address string `xml:"address,attr"`
+	} `xml:"mac"`
+	Source struct {
+		Bridge  string `xml:"bridge,attr"`
+		Network string `xml:"network,attr"`
+	} `xml:"source"`
+	VLANTags []struct {
+		ID int `xml:"id,attr"`
+	} `xml:"vlan>tag"`
+	Model struct {
+		Type string `xml:"type,attr"`
+	} `xml:"model"`
+	Link struct {
+		State string `xml:"state,attr"`
+	} `xml:"link"`
+}
+
+// ###################################
+//	PARSE LIBVIRT DOMAIN
+// ###################################
+
+// Parses a libvirt domain XML definition (e.g. /etc/libvirt/qemu/name.xml or virsh dumpxml output) into guest information
+func parseLibvirtDomain(configFilePath string, domainXML string) (guest GuestConfig, err error) {
+	var domain libvirtDomain
+	err = xml.Unmarshal([]byte(domainXML), &domain)
+	if err != nil {
+		err = fmt.Errorf("invalid domain XML: %v", err)
+		return
+	}
+
+	guest.VMID = domain.Name
+	guest.Type = guestTypeLibvirt
+	guest.Name = domain.Name
+	guest.ConfigPath = configFilePath
+
+	for index, domainInterface := range domain.Interfaces {
+		nic := GuestNIC{
+			Key:        fmt.Sprintf("interface%d", index),
+			Model:      domainInterface.Model.Type,
+			MACAddress: strings.ToUpper(domainInterface.MAC.Address),
+			Bridge:     domainInterface.Source.Bridge,
+			LinkDown:   domainInterface.Link.State == "down",
+		}
+
+		// Interfaces on a libvirt network report the network name as their bridge
+		if nic.Bridge == "" {
+			nic.Bridge = domainInterface.Source.Network
+		}
+
+		// Only a single untrunked tag maps to an access VLAN
+		if len(domainInterface.VLANTags) == 1 {
+			nic.VLANTag = domainInterface.VLANTags[0].ID
+		}
+
+		guest.NICs = append(guest.NICs, nic)
+	}
+
+	return
+}
+
+// Checks if a config directory holds libvirt domain XML files (missing directories are reported when the inventory is read)
+func containsLibvirtDomains(VMConfigPath string) (found bool) {
+	configFiles, err := os.ReadDir(VMConfigPath)
+	if err != nil {
+		return
+	}
+
+	for _, dirEntry := range configFiles {
+		if !dirEntry.IsDir() && strings.HasSuffix(dirEntry.Name(), ".xml") {
+			found = true
+			return
+		}
+	}
+	return
+}
+
+// ###################################
+//	VIRSH CONTROLLER
+// ###################################
+
+// Controls libvirt domains on the local host using virsh
+type virshController struct {
+	statusTimeout time.Duration
+	actionTimeout time.Duration
+}
+
+// Ensures guest is a libvirt domain, Proxmox VMIDs are not domain names known to virsh
+func requireLibvirtGuest(guest GuestConfig) (err error) {
+	if guest.Type != guestTypeLibvirt {
+		err = fmt.Errorf("%s %s is a Proxmox guest and cannot be controlled by the '%s' power backend", guestTypeName(guest.Type), guest.VMID, backendVirsh)
+	}
+	return
+}
+
+// Runs a virsh subcommand against the domain, including command output in errors
+func (controller *virshController) run(guest GuestConfig, timeout time.Duration, subcommand string) (output string, err error) {
+	err = requireLibvirtGuest(guest)
+	if err != nil {
+		return
+	}
+
+	output, err = runCommand(timeout, "virsh", subcommand, guest.VMID)
+	return
+}
+
+func (controller *virshController) Status(guest GuestConfig) (state GuestState, err error) {
+	output, err := controller.run(guest, controller.statusTimeout, "domstate")
+	if err != nil {
+		return
+	}
+
+	// Output is one of: running, idle, paused, in shutdown, shut off, crashed, pmsuspended
+	switch strings.TrimSpace(output) {
+	case "running", "idle", "in shutdown":
+		state = guestRunning
+	case "paused":
+		state = guestPaused
+	case "pmsuspended":
+		state = guestSuspended
+	default:
+		state = guestStopped
+	}
+	return
+}
+
+func (controller *virshController) Start(guest GuestConfig) (err error) {
+	_, err = controller.run(guest, controller.actionTimeout, "start")
+	return
+}
+
+func (controller *virshController) Resume(guest GuestConfig) (err error) {
+	_, err = controller.run(guest, controller.actionTimeout, "resume")
+	return
+}
+
+func (controller *virshController) Wakeup(guest GuestConfig) (err error) {
+	_, err = controller.run(guest, controller.actionTimeout, "dompmwakeup")
+	return
+}
+
+func (controller *virshController) Stop(guest GuestConfig) (err error) {
+	_, err = controller.run(guest, controller.actionTimeout, "destroy")
+	return
+}
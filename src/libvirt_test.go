@@ -0,0 +1,27 @@
+// wakeonlanpve
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVirshControllerRejectsProxmoxGuest(t *testing.T) {
+	controller := &virshController{statusTimeout: time.Second, actionTimeout: time.Second}
+
+	for _, guest := range []GuestConfig{{VMID: "104", Type: "qemu-server"}, {VMID: "200", Type: "lxc"}} {
+		_, err := controller.Status(guest)
+		if err == nil || !strings.Contains(err.Error(), "Proxmox guest") {
+			t.Errorf("%s %s: expected status to be rejected, got: %v", guest.Type, guest.VMID, err)
+		}
+		err = controller.Start(guest)
+		if err == nil || !strings.Contains(err.Error(), "Proxmox guest") {
+			t.Errorf("%s %s: expected start to be rejected, got: %v", guest.Type, guest.VMID, err)
+		}
+		err = controller.Resume(guest)
+		if err == nil || !strings.Contains(err.Error(), "Proxmox guest") {
+			t.Errorf("%s %s: expected resume to be rejected, got: %v", guest.Type, guest.VMID, err)
+		}
+	}
+}
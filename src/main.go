@@ -10,43 +10,96 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 )
 
 const progVersion string = "v1.0.5"
 
 type Config struct {
-	ListenIntf            []ListenInterfaceParams `json:"listenIntf"`
-	VMConfigPaths         []string                `json:"pathToVMConfigurations"`
-	RemoteLogEnabled      bool                    `json:"syslogEnabled"`
-	SyslogDestinationIP   string                  `json:"syslogDestinationIP"`
-	SyslogDestinationPort string                  `json:"syslogDestinationPort"`
+	ListenIntf             []ListenInterfaceParams `json:"listenIntf"`
+	VMConfigPaths          []string                `json:"pathToVMConfigurations"`
+	RemoteLogEnabled       bool                    `json:"syslogEnabled"`
+	SyslogDestinationIP    string                  `json:"syslogDestinationIP"`
+	SyslogDestinationPort  string                  `json:"syslogDestinationPort"`
+	SecureOnPasswords      map[string]string       `json:"secureOnPasswords"`
+	InventoryRescanSeconds int                     `json:"inventoryRescanSeconds"`
+	DuplicateMACPolicy     string                  `json:"duplicateMACPolicy"`
+	PowerBackend           string                  `json:"powerBackend"`
+	ProxmoxAPI             ProxmoxAPIParams        `json:"proxmoxAPI"`
+	DryRun                 bool                    `json:"dryRun"`
+	WakeCooldownSeconds    *int                    `json:"wakeCooldownSeconds"`
+	GuestCooldownSeconds   map[string]int          `json:"guestCooldownSeconds"`
+	MaxConcurrentStarts    int                     `json:"maxConcurrentStarts"`
+	WakeQueueSize          int                     `json:"wakeQueueSize"`
+	StatusTimeoutSeconds   int                     `json:"statusTimeoutSeconds"`
+	StartTimeoutSeconds    int                     `json:"startTimeoutSeconds"`
+	StartAttempts          int                     `json:"startAttempts"`
+	RetryBackoffSeconds    int                     `json:"retryBackoffSeconds"`
+	QMPSocketDir           string                  `json:"qmpSocketDir"`
+	WakePolicy             []WakePolicyRule        `json:"wakePolicy"`
+	CaptureStatsSeconds    int                     `json:"captureStatsSeconds"`
+	AllowTags              []string                `json:"allowTags"`
+	DenyTags               []string                `json:"denyTags"`
 }
 
 type ListenInterfaceParams struct {
-	ListenIntf    string   `json:"listenIntf"`
-	FilterSrcMAC  []string `json:"filterSrcMAC"`
-	FilterSrcIP   []string `json:"filterSrcIP"`
-	FilterDstIP   []string `json:"filterDstIP"`
-	FilterDstMAC  []string `json:"filterDstMAC"`
-	FilterDstPort string   `json:"filterDstPort"`
-	PromiscMode   bool     `json:"PromiscuousMode"`
+	ListenIntf      string   `json:"listenIntf"`
+	FilterSrcMAC    []string `json:"filterSrcMAC"`
+	FilterSrcIP     []string `json:"filterSrcIP"`
+	FilterDstIP     []string `json:"filterDstIP"`
+	FilterDstMAC    []string `json:"filterDstMAC"`
+	FilterDstPort   string   `json:"filterDstPort"`
+	PromiscMode     bool     `json:"PromiscuousMode"`
+	ValidationMode  string   `json:"validationMode"`
+	RawEthernetWOL  bool     `json:"rawEthernetWOL"`
+	MatchBridge     bool     `json:"matchBridge"`
+	MatchVLANTag    bool     `json:"matchVLANTag"`
+	MatchPacketVLAN bool     `json:"matchPacketVLAN"`
+	AllowedVLANs    []int    `json:"allowedVLANs"`
+	RawFilter       string   `json:"rawFilter"`
+	RawFilterMode   string   `json:"rawFilterMode"`
+	KernelPrefilter string   `json:"kernelPrefilter"`
+	CaptureBackend  string   `json:"captureBackend"`
 }
 
 var remoteLogEnabled bool
 var syslogAddress *net.UDPAddr
 
+// MAC to guest index shared by all listeners
+var guestInventory *GuestInventory
+
+// Power control backend shared by all listeners
+var guestController GuestController
+
+// Per-guest wake cooldown shared by all listeners
+var wakeDebounce *wakeDebouncer
+
+// Power on worker pool shared by all listeners
+var wakeWorkers *wakeWorkerPool
+
+// Full inventory rescan interval if not set in config (inotify does not see changes made by other cluster nodes)
+const defaultInventoryRescanSeconds int = 300
+
 func main() {
 	var configFile string
 	var startServerFlagExists bool
 	var installServerRequested bool
 	var versionFlagExists bool
 	var versionNumberFlagExists bool
+	var showInventoryRequested bool
+	var dryRunRequested bool
+	var replayFile string
+	var replayInterface string
 
 	const usage = `
 Options:
     -c, --config </path/to/json>    Path to the configuration file [default: wol-config.json]
     -s, --start-server              Start WOL Server (Requires '--config')
+    -n, --dry-run                   Log the VM/LXCs that would be started instead of starting them
+        --replay </path/to/pcap>    Process a saved packet capture instead of listening (Requires '--config')
+        --replay-interface <name>   Listen interface from config whose filter is used for replay [default: first]
         --install-server            Start installation for server daemon
+        --show-inventory            Print MAC to VM/LXC inventory built from config paths (Requires '--config')
     -h, --help                      Show this help menu
     -V, --version                   Show version and packages
     -v, --versionid                 Show only version number
@@ -59,7 +112,12 @@ General help using GNU software: <https://www.gnu.org/gethelp/>
 	flag.StringVar(&configFile, "config", "wolpve-config.json", "")
 	flag.BoolVar(&startServerFlagExists, "s", false, "")
 	flag.BoolVar(&startServerFlagExists, "start-server", false, "")
+	flag.BoolVar(&dryRunRequested, "n", false, "")
+	flag.BoolVar(&dryRunRequested, "dry-run", false, "")
+	flag.StringVar(&replayFile, "replay", "", "")
+	flag.StringVar(&replayInterface, "replay-interface", "", "")
 	flag.BoolVar(&installServerRequested, "install-server", false, "")
+	flag.BoolVar(&showInventoryRequested, "show-inventory", false, "")
 	flag.BoolVar(&versionFlagExists, "V", false, "")
 	flag.BoolVar(&versionFlagExists, "version", false, "")
 	flag.BoolVar(&versionNumberFlagExists, "v", false, "")
@@ -70,13 +128,23 @@ General help using GNU software: <https://www.gnu.org/gethelp/>
 
 	if versionFlagExists {
 		fmt.Printf("WakeOnLAN_PVE %s compiled using %s(%s) on %s architecture %s\n", progVersion, runtime.Version(), runtime.Compiler, runtime.GOOS, runtime.GOARCH)
-		fmt.Print("Direct Package Imports: runtime encoding/hex strings golang.org/x/term encoding/json flag fmt time log/syslog os/exec net github.com/google/gopacket os sync path/filepath github.com/google/gopacket/pcap io/fs\n")
+		fmt.Print("Direct Package Imports: runtime encoding/hex strings golang.org/x/term encoding/json flag fmt time log/syslog os/exec net github.com/google/gopacket os sync path/filepath github.com/google/gopacket/pcap io/fs crypto/subtle bytes github.com/google/gopacket/layers os/signal sort syscall unsafe golang.org/x/sys/unix strconv crypto/tls crypto/x509 io net/http net/url encoding/xml context errors bufio regexp encoding/binary sync/atomic\n")
 	} else if versionNumberFlagExists {
 		fmt.Println(progVersion)
 	} else if installServerRequested {
 		installServer()
+	} else if showInventoryRequested {
+		err := showInventory(configFile)
+		if err != nil {
+			logError("failed to show inventory", err, true)
+		}
+	} else if replayFile != "" {
+		err := replayCapture(configFile, replayFile, replayInterface, dryRunRequested)
+		if err != nil {
+			logError("failed to replay capture", err, true)
+		}
 	} else if startServerFlagExists {
-		err := startServer(configFile)
+		err := startServer(configFile, dryRunRequested)
 		if err != nil {
 			logError("failed to start server", err, true)
 		}
@@ -84,23 +152,145 @@ General help using GNU software: <https://www.gnu.org/gethelp/>
 }
 
 // ###################################
-//	PROCESS PACKETS
+//	LOAD CONFIG
 // ###################################
 
-func startServer(configFile string) (err error) {
+// Reads JSON config file and normalizes/validates the optional fields
+func loadConfig(configFile string) (config Config, err error) {
 	jsonConfigFile, err := os.ReadFile(configFile)
 	if err != nil {
 		err = fmt.Errorf("failed to read config file: %v", err)
 		return
 	}
 
-	var config Config
 	err = json.Unmarshal(jsonConfigFile, &config)
 	if err != nil {
 		err = fmt.Errorf("failed to parse JSON config: %v", err)
 		return
 	}
 
+	// Only virsh (and the fake backend) can control libvirt domains, qm/pct and the Proxmox API do not know them
+	libvirtBackend := config.PowerBackend == backendVirsh || config.PowerBackend == backendFake
+
+	// Normalize SecureOn passwords (keyed by VMID, domain name, or MAC) to the same format extracted from packets
+	config.SecureOnPasswords, err = parseSecureOnPasswords(config.SecureOnPasswords, libvirtBackend)
+	if err != nil {
+		err = fmt.Errorf("invalid SecureOn password configuration: %v", err)
+		return
+	}
+
+	if !libvirtBackend {
+		for _, VMConfigPath := range config.VMConfigPaths {
+			if containsLibvirtDomains(VMConfigPath) {
+				err = fmt.Errorf("config path %s contains libvirt domain XML files, which require the '%s' power backend", VMConfigPath, backendVirsh)
+				return
+			}
+		}
+	}
+
+	for _, intfParams := range config.ListenIntf {
+		err = validateValidationMode(intfParams.ValidationMode)
+		if err != nil {
+			err = fmt.Errorf("invalid config for interface %s: %v", intfParams.ListenIntf, err)
+			return
+		}
+
+		_, err = newBridgeScope(intfParams)
+		if err != nil {
+			err = fmt.Errorf("invalid config for interface %s: %v", intfParams.ListenIntf, err)
+			return
+		}
+
+		err = validateCaptureBackend(intfParams)
+		if err != nil {
+			err = fmt.Errorf("invalid config for interface %s: %v", intfParams.ListenIntf, err)
+			return
+		}
+
+		for _, VLAN := range intfParams.AllowedVLANs {
+			if VLAN < 0 || VLAN > 4094 {
+				err = fmt.Errorf("invalid config for interface %s: allowed VLAN %d must be between 0 (untagged) and 4094", intfParams.ListenIntf, VLAN)
+				return
+			}
+		}
+	}
+
+	err = validateDuplicatePolicy(config.DuplicateMACPolicy)
+	if err != nil {
+		return
+	}
+
+	err = validateCooldowns(config.WakeCooldownSeconds, config.GuestCooldownSeconds)
+	if err != nil {
+		return
+	}
+	if config.WakeCooldownSeconds == nil {
+		cooldownSeconds := defaultWakeCooldownSeconds
+		config.WakeCooldownSeconds = &cooldownSeconds
+	}
+
+	if config.MaxConcurrentStarts < 0 || config.WakeQueueSize < 0 {
+		err = fmt.Errorf("maxConcurrentStarts and wakeQueueSize must not be negative")
+		return
+	}
+	if config.MaxConcurrentStarts == 0 {
+		config.MaxConcurrentStarts = defaultMaxConcurrentStarts
+	}
+	if config.WakeQueueSize == 0 {
+		config.WakeQueueSize = defaultWakeQueueSize
+	}
+
+	if config.StatusTimeoutSeconds < 0 || config.StartTimeoutSeconds < 0 || config.StartAttempts < 0 || config.RetryBackoffSeconds < 0 {
+		err = fmt.Errorf("statusTimeoutSeconds, startTimeoutSeconds, startAttempts, and retryBackoffSeconds must not be negative")
+		return
+	}
+	if config.StatusTimeoutSeconds == 0 {
+		config.StatusTimeoutSeconds = defaultStatusTimeoutSeconds
+	}
+	if config.StartTimeoutSeconds == 0 {
+		config.StartTimeoutSeconds = defaultStartTimeoutSeconds
+	}
+	if config.StartAttempts == 0 {
+		config.StartAttempts = defaultStartAttempts
+	}
+	if config.RetryBackoffSeconds == 0 {
+		config.RetryBackoffSeconds = defaultRetryBackoffSeconds
+	}
+
+	if config.QMPSocketDir == "" {
+		config.QMPSocketDir = defaultQMPSocketDir
+	}
+
+	if config.CaptureStatsSeconds < 0 {
+		err = fmt.Errorf("captureStatsSeconds must not be negative")
+		return
+	}
+
+	if config.InventoryRescanSeconds < 0 {
+		err = fmt.Errorf("inventoryRescanSeconds must not be negative")
+		return
+	} else if config.InventoryRescanSeconds == 0 {
+		config.InventoryRescanSeconds = defaultInventoryRescanSeconds
+	}
+
+	return
+}
+
+// ###################################
+//	PROCESS PACKETS
+// ###################################
+
+func startServer(configFile string, dryRunRequested bool) (err error) {
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return
+	}
+
+	// Command line can enable dry run regardless of config
+	if dryRunRequested {
+		config.DryRun = true
+	}
+
 	if config.RemoteLogEnabled {
 		// Set address in global for awareness
 		if strings.Contains(config.SyslogDestinationIP, ":") {
@@ -119,22 +309,63 @@ func startServer(configFile string) (err error) {
 
 	logMessage("WOL-PVE Server (%s) starting...", progVersion)
 
+	if config.DryRun {
+		logMessage("Dry run enabled, VM/LXCs will not be started")
+	}
+
+	err = setupGuestHandling(config)
+	if err != nil {
+		return
+	}
+
+	// Keep MAC inventory current from filesystem changes
+	go guestInventory.watch(time.Duration(config.InventoryRescanSeconds) * time.Second)
+	go guestInventory.dumpOnSignal()
+
 	// Start packet captures for each listening interface
 	if len(config.ListenIntf) == 1 {
 		// If we are only listening on one interface, don't use a go routine (still have to use wait group)
 		var WaitGroup sync.WaitGroup
 		WaitGroup.Add(1)
-		captureAndProcessPackets(&WaitGroup, config.ListenIntf[0], config.VMConfigPaths)
+		captureAndProcessPackets(&WaitGroup, config.ListenIntf[0], &config)
 		WaitGroup.Wait()
 	} else {
 		// One go routine per listen interface
 		var WaitGroup sync.WaitGroup
 		for _, intfParams := range config.ListenIntf {
 			WaitGroup.Add(1)
-			go captureAndProcessPackets(&WaitGroup, intfParams, config.VMConfigPaths)
+			go captureAndProcessPackets(&WaitGroup, intfParams, &config)
 		}
 		WaitGroup.Wait()
 	}
 
 	return
 }
+
+// Creates the power backend, wake cooldowns, power on workers, and MAC inventory shared by all listeners
+func setupGuestHandling(config Config) (err error) {
+	guestController, err = newGuestController(config)
+	if err != nil {
+		err = fmt.Errorf("failed to setup power backend: %v", err)
+		return
+	}
+
+	wakeAuthorization, err = newWakePolicy(config.WakePolicy)
+	if err != nil {
+		err = fmt.Errorf("invalid wake policy: %v", err)
+		return
+	}
+
+	powerRetry = retryPolicy{attempts: config.StartAttempts, backoff: time.Duration(config.RetryBackoffSeconds) * time.Second}
+	wakeDebounce = newWakeDebouncer(*config.WakeCooldownSeconds, config.GuestCooldownSeconds)
+	wakeWorkers = startWakeWorkers(config.MaxConcurrentStarts, config.WakeQueueSize)
+
+	// Build MAC inventory once
+	guestInventory = newGuestInventory(config.VMConfigPaths)
+	err = guestInventory.rescan()
+	if err != nil {
+		err = fmt.Errorf("failed to build guest inventory: %v", err)
+		return
+	}
+	return
+}
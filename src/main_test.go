@@ -0,0 +1,41 @@
+// wakeonlanpve
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Writes config JSON to a temporary file and loads it
+func loadTestConfig(t *testing.T, configJSON string) (config Config, err error) {
+	configFile := filepath.Join(t.TempDir(), "wol-config.json")
+	err = os.WriteFile(configFile, []byte(configJSON), 0600)
+	if err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	config, err = loadConfig(configFile)
+	return
+}
+
+func TestLoadConfigLibvirtPathRequiresVirsh(t *testing.T) {
+	libvirtDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(libvirtDir, "webserver.xml"), []byte("<domain><name>webserver</name></domain>"), 0600)
+	if err != nil {
+		t.Fatalf("failed to write domain XML: %v", err)
+	}
+
+	for _, backend := range []string{"", "cli", "api"} {
+		_, err = loadTestConfig(t, `{"powerBackend":"`+backend+`","pathToVMConfigurations":["`+libvirtDir+`"]}`)
+		if err == nil || !strings.Contains(err.Error(), "libvirt domain XML") {
+			t.Errorf("backend '%s': expected libvirt path to be rejected, got: %v", backend, err)
+		}
+	}
+
+	_, err = loadTestConfig(t, `{"powerBackend":"virsh","pathToVMConfigurations":["`+libvirtDir+`"]}`)
+	if err != nil {
+		t.Errorf("unexpected error with virsh backend: %v", err)
+	}
+}
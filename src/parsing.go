@@ -6,15 +6,31 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
+// Restricts MAC matches to guest NICs attached to the bridge (and VLAN) a listener captures on
+type bridgeScope struct {
+	enabled    bool // Check NIC bridge
+	bridge     string
+	checkTag   bool
+	VLANTag    int  // 0 for untagged
+	packetVLAN bool // VLANTag is taken from each packet instead of the interface name
+}
+
+// Bridge created by PVE for a VLAN on a non VLAN-aware bridge (vmbr0v20)
+var pveVLANBridgeName = regexp.MustCompile(`^(.*[0-9])v([0-9]+)$`)
+
 // ###################################
 //	MATCH MAC TO VM
 // ###################################
 
-// Finds matching MAC address in Proxmox VM configuration files and retrieves the VM ID, Type, and name
-func matchMACtoVM(MACAddress string, VMConfigPaths []string) (VMID string, VMTYPE string, VMNAME string, err error) {
+// Finds the guests with a NIC matching the MAC address in the inventory
+// If scoped, guests whose NIC is not on the listener bridge/VLAN are ignored
+// If multiple guests share the MAC, the duplicate policy decides which of them (if any) are returned
+func matchMACtoVM(MACAddress string, scope bridgeScope, inventory *GuestInventory, duplicatePolicy string) (guests []GuestConfig, err error) {
 	// Recover from panic
 	defer func() {
 		if r := recover(); r != nil {
@@ -22,7 +38,154 @@ func matchMACtoVM(MACAddress string, VMConfigPaths []string) (VMID string, VMTYP
 		}
 	}()
 
-	// Search through VM config directories for a matching mac address from the packet payload
+	matchedGuests, found := inventory.lookup(MACAddress)
+	if !found {
+		return
+	}
+
+	if scope.enabled || scope.checkTag {
+		var scopedGuests []GuestConfig
+		for _, guest := range matchedGuests {
+			if scope.contains(guest, MACAddress) {
+				scopedGuests = append(scopedGuests, guest)
+			}
+		}
+
+		if len(scopedGuests) == 0 {
+			err = fmt.Errorf("MAC address belongs to %s, which is not on %s", describeGuests(matchedGuests), scope)
+			return
+		}
+		matchedGuests = scopedGuests
+	}
+
+	for _, guest := range matchedGuests {
+		if guest.Name == "" {
+			err = fmt.Errorf("found MAC address in file '%s' but could not identify a VM name anywhere in the file", guest.ConfigPath)
+			return
+		}
+	}
+
+	guests, err = applyDuplicatePolicy(matchedGuests, duplicatePolicy)
+	return
+}
+
+// Derives bridge and VLAN from the listen interface name
+//
+//	vmbr1     -> bridge vmbr1, untagged
+//	vmbr1.20  -> bridge vmbr1, VLAN 20 (VLAN-aware bridge)
+//	vmbr1v20  -> bridge vmbr1, VLAN 20 (PVE bridge for a VLAN on a non VLAN-aware bridge)
+//
+// With matchPacketVLAN, the NIC tag is compared to the 802.1Q VLAN of each packet instead
+func newBridgeScope(PCAPParameters ListenInterfaceParams) (scope bridgeScope, err error) {
+	if PCAPParameters.MatchVLANTag && PCAPParameters.MatchPacketVLAN {
+		err = fmt.Errorf("matchVLANTag and matchPacketVLAN cannot both be enabled")
+		return
+	}
+
+	if PCAPParameters.MatchPacketVLAN {
+		scope.checkTag = true
+		scope.packetVLAN = true
+	}
+
+	if !PCAPParameters.MatchBridge {
+		if PCAPParameters.MatchVLANTag {
+			err = fmt.Errorf("matchVLANTag requires matchBridge")
+		}
+		return
+	}
+
+	scope.enabled = true
+	scope.checkTag = PCAPParameters.MatchVLANTag || PCAPParameters.MatchPacketVLAN
+	scope.bridge = PCAPParameters.ListenIntf
+
+	var VLAN string
+	if bridge, subinterfaceVLAN, found := strings.Cut(PCAPParameters.ListenIntf, "."); found {
+		scope.bridge, VLAN = bridge, subinterfaceVLAN
+	} else if nameParts := pveVLANBridgeName.FindStringSubmatch(PCAPParameters.ListenIntf); nameParts != nil {
+		scope.bridge, VLAN = nameParts[1], nameParts[2]
+	}
+
+	if VLAN != "" && !scope.packetVLAN {
+		scope.VLANTag, err = strconv.Atoi(VLAN)
+		if err != nil || scope.VLANTag < 1 || scope.VLANTag > 4094 {
+			err = fmt.Errorf("invalid VLAN '%s' in interface name %s", VLAN, PCAPParameters.ListenIntf)
+			return
+		}
+	}
+	return
+}
+
+// Scope for a packet received with VLAN ID (0 if untagged)
+func (scope bridgeScope) forPacket(VLAN int) (packetScope bridgeScope) {
+	packetScope = scope
+	if scope.packetVLAN {
+		packetScope.VLANTag = VLAN
+	}
+	return
+}
+
+// Checks if the guest NIC with the MAC address is on the scope bridge (and VLAN)
+func (scope bridgeScope) contains(guest GuestConfig, MACAddress string) (inScope bool) {
+	nic, found := guest.findNIC(MACAddress)
+	if !found {
+		return
+	}
+
+	if scope.enabled && nic.Bridge != scope.bridge {
+		return
+	}
+
+	if scope.checkTag && nic.VLANTag != scope.VLANTag {
+		return
+	}
+
+	inScope = true
+	return
+}
+
+// Scope description for messages
+func (scope bridgeScope) String() (description string) {
+	var scopeParts []string
+	if scope.enabled {
+		scopeParts = append(scopeParts, "bridge "+scope.bridge)
+	}
+	if scope.checkTag {
+		if scope.VLANTag == 0 {
+			scopeParts = append(scopeParts, "untagged")
+		} else {
+			scopeParts = append(scopeParts, fmt.Sprintf("VLAN %d", scope.VLANTag))
+		}
+	}
+	description = strings.Join(scopeParts, " ")
+	return
+}
+
+// Checks packet VLAN (0 if untagged) against the interface allowed VLANs (any if none configured)
+func isVLANAllowed(VLAN int, allowedVLANs []int) (allowed bool) {
+	if len(allowedVLANs) == 0 {
+		allowed = true
+		return
+	}
+
+	for _, allowedVLAN := range allowedVLANs {
+		if VLAN == allowedVLAN {
+			allowed = true
+			return
+		}
+	}
+	return
+}
+
+// ###################################
+//	READ VM CONFIGS
+// ###################################
+
+// Reads and parses every guest configuration file in the config directories
+// Unreadable files are skipped, and only reported if nothing could be read at all
+func readGuestConfigs(VMConfigPaths []string) (guests []GuestConfig, err error) {
+	// Last config read/parse failure
+	var readErr error
+
 	for _, VMConfigPath := range VMConfigPaths {
 		// Get a list of files in directory
 		var configFiles []fs.DirEntry
@@ -32,69 +195,61 @@ func matchMACtoVM(MACAddress string, VMConfigPaths []string) (VMID string, VMTYP
 			return
 		}
 
-		// Search through files in this directory for matching MAC
 		for _, dirEntry := range configFiles {
 			// Skip sub-directories
 			if dirEntry.IsDir() {
 				continue
 			}
 
-			// Get name of file
-			configFile := dirEntry.Name()
-
-			// Skip files without .conf extension
-			if !strings.HasSuffix(configFile, ".conf") {
+			// Skip files without .conf/.xml extension
+			if !isGuestConfigFile(dirEntry.Name()) {
 				continue
 			}
 
-			// Get full path
-			configFilePath := filepath.Join(VMConfigPath, configFile)
-
-			// Read contents of this config file
-			var configFileBytes []byte
-			configFileBytes, err = os.ReadFile(configFilePath)
-			if err != nil {
-				err = fmt.Errorf(" %s: %v", configFilePath, err)
-			}
-
-			// Convert file contents to string
-			configFileContents := string(configFileBytes)
-
-			// Skip to next file if MAC isn't anywhere in this file
-			if !strings.Contains(strings.ToUpper(configFileContents), MACAddress) {
+			guest, fileErr := readGuestConfig(filepath.Join(VMConfigPath, dirEntry.Name()))
+			if fileErr != nil {
+				logMessage("Skipping VM config:%v", fileErr)
+				readErr = fileErr
 				continue
 			}
 
-			// Found MAC match - add relevant VM info to variables to start VM
-			VMID = strings.TrimSuffix(configFile, ".conf")
-			VMTYPE = filepath.Base(filepath.Dir(configFilePath))
-
-			configLines := strings.Split(configFileContents, "\n")
-			for _, line := range configLines {
-				if strings.HasPrefix(line, "name: ") {
-					// QEMU conf
-					VMNAME = strings.TrimPrefix(line, "name: ")
-				} else if strings.HasPrefix(line, "hostname: ") {
-					// LXC conf
-					VMNAME = strings.TrimPrefix(line, "hostname: ")
-				}
-			}
+			guests = append(guests, guest)
+		}
+	}
 
-			if VMNAME == "" {
-				err = fmt.Errorf("found MAC address in file '%s' but could not identify a VM name anywhere in the file", configFilePath)
-				return
-			}
+	// This is to catch failed reads of config files, but only when every read failed
+	if readErr != nil && len(guests) == 0 {
+		err = fmt.Errorf("failed to read VM config(s):%v", readErr)
+		return
+	}
 
-			VMNAME = strings.TrimSpace(VMNAME)
-		}
+	return
+}
 
-		// Only error out if a VMID, VMTYPE was not found and err is present
-		// This is to catch failed reads of config files, but only when the entire MAC search failed
-		if err != nil && len(VMID) == 0 && VMTYPE == "" {
-			err = fmt.Errorf("failed to read VM config(s):%v", err)
-			return
-		}
+// Reads and parses a single Proxmox VM configuration file or libvirt domain XML file
+func readGuestConfig(configFilePath string) (guest GuestConfig, err error) {
+	configFileBytes, err := os.ReadFile(configFilePath)
+	if err != nil {
+		err = fmt.Errorf(" %s: %v", configFilePath, err)
+		return
+	}
+
+	// Parse guest NICs from libvirt domain XML or the current Proxmox config (ignoring snapshots and pending changes)
+	if strings.HasSuffix(configFilePath, ".xml") {
+		guest, err = parseLibvirtDomain(configFilePath, string(configFileBytes))
+	} else {
+		guest, err = parseGuestConfig(configFilePath, string(configFileBytes))
+	}
+	if err != nil {
+		err = fmt.Errorf(" %s: %v", configFilePath, err)
+		return
 	}
 
 	return
 }
+
+// Checks if a file name is a guest configuration file (Proxmox .conf or libvirt domain .xml)
+func isGuestConfigFile(fileName string) (isConfig bool) {
+	isConfig = strings.HasSuffix(fileName, ".conf") || strings.HasSuffix(fileName, ".xml")
+	return
+}
@@ -3,18 +3,18 @@ package main
 
 import (
 	"fmt"
-	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/pcap"
 )
 
 // ###################################
 //	PROCESS PACKETS
 // ###################################
 
-func captureAndProcessPackets(WaitGroup *sync.WaitGroup, PCAPParameters ListenInterfaceParams, VMConfigPaths []string) {
+// Opens live capture on the listen interface and processes packets until the capture fails
+func captureAndProcessPackets(WaitGroup *sync.WaitGroup, PCAPParameters ListenInterfaceParams, config *Config) {
 	// Recover from panic
 	defer func() {
 		if r := recover(); r != nil {
@@ -24,70 +24,205 @@ func captureAndProcessPackets(WaitGroup *sync.WaitGroup, PCAPParameters ListenIn
 
 	defer WaitGroup.Done()
 
-	// Open packet capture handle
-	PCAPHandle, err := pcap.OpenLive(PCAPParameters.ListenIntf, 1600, PCAPParameters.PromiscMode, pcap.BlockForever)
+	// Open capture with the interface backend and filter from config
+	source, err := openCaptureSource(PCAPParameters)
 	if err != nil {
-		logError("failed to open capture device", err, false)
+		logError("failed to open packet capture", err, false)
 		return
 	}
-	defer PCAPHandle.Close()
+	defer source.Close()
 
-	// Create BPF filter with parameters from config
-	PCAPfilter := fmt.Sprintf("udp and ether src (%s) and src host (%s) and dst host (%s) and ether dst (%s) and dst port %s",
-		strings.Join(PCAPParameters.FilterSrcMAC, " or "), strings.Join(PCAPParameters.FilterSrcIP, " or "),
-		strings.Join(PCAPParameters.FilterDstIP, " or "), strings.Join(PCAPParameters.FilterDstMAC, " or "), PCAPParameters.FilterDstPort)
-
-	logMessage("Setting capture filter as '%s'", PCAPfilter)
+	logMessage("Listening for WOL packets on interface %s", PCAPParameters.ListenIntf)
 
-	err = PCAPHandle.SetBPFFilter(PCAPfilter)
-	if err != nil {
-		logError("failed to set BPF filter", err, false)
-		return
+	// Periodically show how many packets the filter passed and how many were dropped
+	if config.CaptureStatsSeconds > 0 {
+		captureDone := make(chan struct{})
+		defer close(captureDone)
+		go logCaptureStats(source, PCAPParameters.ListenIntf, time.Duration(config.CaptureStatsSeconds)*time.Second, captureDone)
 	}
 
-	logMessage("Listening for WOL packets on interface %s", PCAPParameters.ListenIntf)
+	packetSource := gopacket.NewPacketSource(source, source.LinkType())
+	processPackets(packetSource, PCAPParameters, config)
+}
+
+// Validates packets from a live or offline capture and wakes the matching guests
+// Returns the number of packets read once the packet source is exhausted (end of capture file)
+func processPackets(packetSource *gopacket.PacketSource, PCAPParameters ListenInterfaceParams, config *Config) (packetCount int) {
+	// Validated when config was loaded
+	scope, _ := newBridgeScope(PCAPParameters)
 
-	packetSource := gopacket.NewPacketSource(PCAPHandle, PCAPHandle.LinkType())
 	for recvPacket := range packetSource.Packets() {
-		// Get headers
-		l2meta := recvPacket.LinkLayer().LinkFlow()
-		l3meta := recvPacket.NetworkLayer().NetworkFlow()
+		packetCount++
+
+		// Get sender addresses for logging and wake policy
+		source := newWakeSource(PCAPParameters.ListenIntf, recvPacket)
 
 		// Ensure payload is valid and extract MAC address
-		MACAddress, err := validatePacket(recvPacket)
+		MACAddress, SecureOnPassword, err := validatePacket(recvPacket, PCAPParameters.ValidationMode)
 		if err != nil {
-			logMessage("Receivd invalid packet from %s (%s): %v", l3meta.Src(), l2meta.Src(), err)
+			logMessage("Receivd invalid packet from %s: %v", source, err)
 			continue
 		}
 
 		// Log reception of WOL packet
-		logMessage("Received Wake-on-LAN packet on interface %s from %s (%s)", PCAPParameters.ListenIntf, l3meta.Src(), l2meta.Src())
+		logMessage("Received Wake-on-LAN packet on interface %s from %s to %s", PCAPParameters.ListenIntf, source, source.destination())
+
+		// Ignore VLANs not allowed on this interface
+		if !isVLANAllowed(source.VLAN, PCAPParameters.AllowedVLANs) {
+			logMessage("Ignored Wake-on-LAN packet from %s: VLAN %d is not allowed on interface %s", source, source.VLAN, PCAPParameters.ListenIntf)
+			continue
+		}
 
 		// Get VM information from matching MAC
-		VMID, VMTYPE, VMNAME, err := matchMACtoVM(MACAddress, VMConfigPaths)
+		guests, err := matchMACtoVM(MACAddress, scope.forPacket(source.VLAN), guestInventory, config.DuplicateMACPolicy)
 		if err != nil {
-			logMessage("Error searching for MAC Address: %v", err)
+			logMessage("Error searching for MAC Address %s: %v", MACAddress, err)
 			continue
 		}
 
-		// Ensure VM information is valid
-		err = validateVMInfo(VMID, VMTYPE, VMNAME)
-		if err != nil {
-			logMessage("Error: %v for MAC %s", err, MACAddress)
+		// Nothing to start if MAC is unknown
+		if len(guests) == 0 {
+			logMessage("Error: could not find VM/LXC for MAC %s", MACAddress)
 			continue
 		}
 
-		// Power on VM depending on type
-		if strings.Contains(VMTYPE, "qemu") {
-			err = powerOn("qm", "VM", VMID, VMNAME)
-		} else if strings.Contains(VMTYPE, "lxc") {
-			err = powerOn("pct", "LXC", VMID, VMNAME)
+		for _, guest := range guests {
+			wakeGuest(guest, MACAddress, SecureOnPassword, source, config)
 		}
+	}
+	return
+}
 
-		// Check for error in either power on function
-		if err != nil {
-			logMessage("%v", err)
-			continue
+// Logs capture statistics every interval until done is closed
+func logCaptureStats(source captureSource, listenIntf string, interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			stats, err := source.Stats()
+			if err != nil {
+				logMessage("Unable to retrieve capture statistics for interface %s: %v", listenIntf, err)
+				continue
+			}
+			logMessage("Capture statistics for interface %s: %d packet(s) passed the filter, %d dropped by the kernel, %d dropped by the interface",
+				listenIntf, stats.received, stats.dropped, stats.interfaceDropped)
+		}
+	}
+}
+
+// ###################################
+//	REPLAY CAPTURE FILE
+// ###################################
+
+// Feeds a saved capture file through the same filter, validation, matching, and power on steps as a live listener
+// The listen interface parameters (filter, validation mode) are taken from the named interface, or the first one in config
+func replayCapture(configFile string, replayFile string, replayInterface string, dryRunRequested bool) (err error) {
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return
+	}
+
+	if dryRunRequested {
+		config.DryRun = true
+	}
+
+	// Select listen interface parameters to replay with
+	var PCAPParameters ListenInterfaceParams
+	var found bool
+	for _, intfParams := range config.ListenIntf {
+		if replayInterface == "" || intfParams.ListenIntf == replayInterface {
+			PCAPParameters = intfParams
+			found = true
+			break
 		}
 	}
+	if !found {
+		err = fmt.Errorf("no listen interface named '%s' in config", replayInterface)
+		return
+	}
+
+	logMessage("WOL-PVE Server (%s) replaying %s with parameters of interface %s", progVersion, replayFile, PCAPParameters.ListenIntf)
+	if config.DryRun {
+		logMessage("Dry run enabled, VM/LXCs will not be started")
+	}
+	logMessage("Wake cooldowns are measured between packet capture timestamps")
+
+	err = setupGuestHandling(config)
+	if err != nil {
+		return
+	}
+
+	// Packets are read faster than they arrived live, so wait for the workers instead of dropping wakes
+	wakeWorkers.blockWhenFull = true
+
+	source, err := openReplayCapture(replayFile, PCAPParameters)
+	if err != nil {
+		return
+	}
+	defer source.Close()
+
+	packetSource := gopacket.NewPacketSource(source, source.LinkType())
+	packetCount := processPackets(packetSource, PCAPParameters, &config)
+
+	// Wait for queued starts before exiting
+	wakeWorkers.drain()
+
+	logMessage("Replay finished: %d packet(s) matched the capture filter", packetCount)
+	return
+}
+
+// Validates guest information, tags, wake policy, and SecureOn password, then queues the guest for power on
+func wakeGuest(guest GuestConfig, MACAddress string, SecureOnPassword string, source wakeSource, config *Config) {
+	VMID, VMTYPE, VMNAME := guest.VMID, guest.Type, guest.Name
+
+	// Ensure VM information is valid
+	err := validateVMInfo(VMID, VMTYPE, VMNAME)
+	if err != nil {
+		logMessage("Error: %v for MAC %s", err, MACAddress)
+		return
+	}
+
+	// Ensure guest opted in to (or out of) wakes with its tags
+	err = checkGuestTags(guest, config.AllowTags, config.DenyTags)
+	if err != nil {
+		logMessage("Denied Wake-on-LAN packet from %s for %s %s - %s: %v", source, guestTypeName(VMTYPE), VMID, VMNAME, err)
+		return
+	}
+
+	// Ensure sender is allowed to wake this guest
+	err = wakeAuthorization.authorize(source, guest)
+	if err != nil {
+		logMessage("Denied Wake-on-LAN packet from %s on interface %s for %s %s - %s: %v", source, source.Interface, guestTypeName(VMTYPE), VMID, VMNAME, err)
+		return
+	}
+
+	// Ensure packet carries the correct SecureOn password if one is configured for this VM
+	err = validateSecureOnPassword(SecureOnPassword, MACAddress, VMID, config.SecureOnPasswords)
+	if err != nil {
+		logMessage("Rejected Wake-on-LAN packet from %s for %s - %s: %v", source, VMID, VMNAME, err)
+		return
+	}
+
+	// Coalesce bursts of packets for the same guest into a single wake
+	allowed, coalesced, window := wakeDebounce.allow(guest, source.Received)
+	if !allowed {
+		logMessage("Coalesced duplicate wake for %s %s - %s (%d within %s cooldown)", guestTypeName(VMTYPE), VMID, VMNAME, coalesced, window)
+		return
+	}
+	if coalesced > 0 {
+		logMessage("Previous wake for %s %s - %s coalesced %d duplicate packet(s)", guestTypeName(VMTYPE), VMID, VMNAME, coalesced)
+	}
+
+	// Hand off to worker pool so capture continues while the guest starts
+	err = wakeWorkers.enqueue(wakeRequest{guest: guest, dryRun: config.DryRun})
+	if err != nil {
+		// Cooldown only applies to wakes that were queued, so client retries can still get through
+		wakeDebounce.cancel(guest, source.Received)
+		logMessage("Dropped wake for %s %s - %s: %v", guestTypeName(VMTYPE), VMID, VMNAME, err)
+		return
+	}
 }
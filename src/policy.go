@@ -0,0 +1,383 @@
+// wakeonlanpve
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Rule in the wakePolicy config section - which sources may wake which guests
+// Empty source lists match any source, and a rule without targets matches any guest
+type WakePolicyRule struct {
+	SourceIPs        []string `json:"sourceIPs"`        // IP addresses or CIDR ranges
+	SourceMACs       []string `json:"sourceMACs"`       // Sender MAC addresses
+	SourceInterfaces []string `json:"sourceInterfaces"` // Listen interfaces the packet arrived on
+	TargetVMIDs      []string `json:"targetVMIDs"`      // VMIDs, libvirt domain names, or inclusive ranges (e.g. 200-299)
+	TargetNames      []string `json:"targetNames"`      // Guest names
+	TargetPools      []string `json:"targetPools"`      // Proxmox resource pools (from user.cfg)
+	TargetTags       []string `json:"targetTags"`       // Proxmox guest tags
+}
+
+// Compiled wake policy - when rules are configured, a wake is only allowed if a rule matches both source and target
+type wakePolicy struct {
+	rules []wakePolicyRule
+}
+
+type wakePolicyRule struct {
+	index      int
+	networks   []*net.IPNet
+	macs       map[string]bool
+	interfaces map[string]bool
+	vmidRanges [][2]int
+	vmids      map[string]bool // Exact IDs (including libvirt domain names)
+	names      map[string]bool
+	pools      []string
+	tags       []string
+}
+
+// Host and interface that sent a WOL packet, and the address it was sent to
+type wakeSource struct {
+	Interface string
+	MAC       net.HardwareAddr
+	IP        net.IP    // nil for raw ethernet WOL frames
+	DstIP     net.IP    // nil for raw ethernet WOL frames
+	VLAN      int       // 802.1Q VLAN ID, 0 if untagged
+	Received  time.Time // Capture timestamp (original time for replayed captures)
+}
+
+// Proxmox cluster-wide user, group, and pool definitions
+const pveUserConfigPath string = "/etc/pve/user.cfg"
+
+// Wake policy shared by all listeners
+var wakeAuthorization *wakePolicy
+
+// ###################################
+//	WAKE SOURCE
+// ###################################
+
+// Retrieves sender addresses of packet received on listen interface
+func newWakeSource(listenIntf string, recvPacket gopacket.Packet) (source wakeSource) {
+	source.Interface = listenIntf
+
+	source.Received = recvPacket.Metadata().Timestamp
+	if source.Received.IsZero() {
+		source.Received = time.Now()
+	}
+
+	if ethernetLayer := recvPacket.Layer(layers.LayerTypeEthernet); ethernetLayer != nil {
+		source.MAC = ethernetLayer.(*layers.Ethernet).SrcMAC
+	}
+
+	if dot1QLayer := recvPacket.Layer(layers.LayerTypeDot1Q); dot1QLayer != nil {
+		source.VLAN = int(dot1QLayer.(*layers.Dot1Q).VLANIdentifier)
+	}
+
+	if ipv4Layer := recvPacket.Layer(layers.LayerTypeIPv4); ipv4Layer != nil {
+		source.IP = ipv4Layer.(*layers.IPv4).SrcIP
+		source.DstIP = ipv4Layer.(*layers.IPv4).DstIP
+	} else if ipv6Layer := recvPacket.Layer(layers.LayerTypeIPv6); ipv6Layer != nil {
+		source.IP = ipv6Layer.(*layers.IPv6).SrcIP
+		source.DstIP = ipv6Layer.(*layers.IPv6).DstIP
+	}
+	return
+}
+
+// Formats IP for logging - IPv6 link-local addresses are only unique per interface, so they include it as zone
+func (source wakeSource) formatIP(IP net.IP) (address string) {
+	address = IP.String()
+	if IP.To4() == nil && (IP.IsLinkLocalUnicast() || IP.IsLinkLocalMulticast() || IP.IsInterfaceLocalMulticast()) {
+		address += "%" + source.Interface
+	}
+	return
+}
+
+// Destination address of the packet for logging (IPv4/IPv6 broadcast, multicast, or unicast)
+func (source wakeSource) destination() (destination string) {
+	if source.DstIP == nil {
+		destination = "raw ethernet"
+		return
+	}
+
+	destination = source.formatIP(source.DstIP)
+	if source.DstIP.IsMulticast() {
+		destination += " (multicast)"
+	}
+	return
+}
+
+// Sender addresses (and VLAN if tagged) for logging
+func (source wakeSource) String() (packetSender string) {
+	if source.IP == nil {
+		packetSender = source.MAC.String() + " (raw ethernet)"
+	} else {
+		packetSender = fmt.Sprintf("%s (%s)", source.formatIP(source.IP), source.MAC)
+	}
+
+	if source.VLAN != 0 {
+		packetSender += fmt.Sprintf(" on VLAN %d", source.VLAN)
+	}
+	return
+}
+
+// ###################################
+//	COMPILE POLICY
+// ###################################
+
+// Validates and compiles policy rules from config
+func newWakePolicy(configRules []WakePolicyRule) (policy *wakePolicy, err error) {
+	policy = &wakePolicy{}
+
+	for index, configRule := range configRules {
+		rule := wakePolicyRule{
+			index:      index + 1,
+			macs:       make(map[string]bool),
+			interfaces: make(map[string]bool),
+			vmids:      make(map[string]bool),
+			names:      make(map[string]bool),
+			pools:      configRule.TargetPools,
+			tags:       configRule.TargetTags,
+		}
+
+		for _, sourceIP := range configRule.SourceIPs {
+			var network *net.IPNet
+			network, err = parseIPOrCIDR(sourceIP)
+			if err != nil {
+				err = fmt.Errorf("wake policy rule %d: %v", rule.index, err)
+				return
+			}
+			rule.networks = append(rule.networks, network)
+		}
+
+		for _, sourceMAC := range configRule.SourceMACs {
+			var MAC net.HardwareAddr
+			MAC, err = net.ParseMAC(sourceMAC)
+			if err != nil {
+				err = fmt.Errorf("wake policy rule %d: invalid source MAC '%s'", rule.index, sourceMAC)
+				return
+			}
+			rule.macs[MAC.String()] = true
+		}
+
+		for _, sourceInterface := range configRule.SourceInterfaces {
+			rule.interfaces[sourceInterface] = true
+		}
+
+		for _, targetVMID := range configRule.TargetVMIDs {
+			// Only numeric bounds make a range, libvirt domain names may contain dashes (web-01)
+			start, end, _ := strings.Cut(targetVMID, "-")
+			startID, startErr := strconv.Atoi(start)
+			endID, endErr := strconv.Atoi(end)
+			if startErr != nil || endErr != nil {
+				rule.vmids[targetVMID] = true
+				continue
+			}
+
+			if startID > endID {
+				err = fmt.Errorf("wake policy rule %d: invalid VMID range '%s'", rule.index, targetVMID)
+				return
+			}
+			rule.vmidRanges = append(rule.vmidRanges, [2]int{startID, endID})
+		}
+
+		for _, targetName := range configRule.TargetNames {
+			rule.names[targetName] = true
+		}
+
+		policy.rules = append(policy.rules, rule)
+	}
+	return
+}
+
+// Parses a single address (as host network) or CIDR range
+func parseIPOrCIDR(address string) (network *net.IPNet, err error) {
+	if strings.Contains(address, "/") {
+		_, network, err = net.ParseCIDR(address)
+		if err != nil {
+			err = fmt.Errorf("invalid source CIDR '%s'", address)
+		}
+		return
+	}
+
+	IP := net.ParseIP(address)
+	if IP == nil {
+		err = fmt.Errorf("invalid source IP '%s'", address)
+		return
+	}
+
+	bits := 8 * len(IP.To16())
+	if IP.To4() != nil {
+		IP = IP.To4()
+		bits = 32
+	}
+	network = &net.IPNet{IP: IP, Mask: net.CIDRMask(bits, bits)}
+	return
+}
+
+// ###################################
+//	AUTHORIZE WAKE
+// ###################################
+
+// Checks if source is allowed to wake guest, returning the reason when denied
+// Every wake is allowed if no rules are configured
+func (policy *wakePolicy) authorize(source wakeSource, guest GuestConfig) (err error) {
+	if policy == nil || len(policy.rules) == 0 {
+		return
+	}
+
+	// Pool membership is read on demand so pool changes apply without restart
+	var guestPools []string
+	poolsLoaded := false
+
+	for _, rule := range policy.rules {
+		if !rule.matchSource(source) {
+			continue
+		}
+
+		if len(rule.pools) > 0 && !poolsLoaded {
+			guestPools, err = readGuestPools(pveUserConfigPath, guest.VMID)
+			if err != nil {
+				logMessage("Warning: unable to read pools for %s - %s, pool targets will not match: %v", guest.VMID, guest.Name, err)
+				err = nil
+			}
+			poolsLoaded = true
+		}
+
+		if rule.matchTarget(guest, guestPools) {
+			return
+		}
+	}
+
+	err = fmt.Errorf("no wake policy rule matches this source and guest")
+	return
+}
+
+// Checks if every configured source condition of rule matches
+func (rule wakePolicyRule) matchSource(source wakeSource) (matched bool) {
+	if len(rule.interfaces) > 0 && !rule.interfaces[source.Interface] {
+		return
+	}
+
+	if len(rule.macs) > 0 && !rule.macs[source.MAC.String()] {
+		return
+	}
+
+	if len(rule.networks) > 0 {
+		if source.IP == nil {
+			return
+		}
+
+		inNetwork := false
+		for _, network := range rule.networks {
+			if network.Contains(source.IP) {
+				inNetwork = true
+				break
+			}
+		}
+		if !inNetwork {
+			return
+		}
+	}
+
+	matched = true
+	return
+}
+
+// Checks if guest is any of the rule targets (or rule has no targets)
+func (rule wakePolicyRule) matchTarget(guest GuestConfig, guestPools []string) (matched bool) {
+	if len(rule.vmids) == 0 && len(rule.vmidRanges) == 0 && len(rule.names) == 0 && len(rule.pools) == 0 && len(rule.tags) == 0 {
+		matched = true
+		return
+	}
+
+	if rule.vmids[guest.VMID] || rule.names[guest.Name] {
+		matched = true
+		return
+	}
+
+	numericID, err := strconv.Atoi(guest.VMID)
+	if err == nil {
+		for _, vmidRange := range rule.vmidRanges {
+			if numericID >= vmidRange[0] && numericID <= vmidRange[1] {
+				matched = true
+				return
+			}
+		}
+	}
+
+	for _, pool := range rule.pools {
+		for _, guestPool := range guestPools {
+			if pool == guestPool {
+				matched = true
+				return
+			}
+		}
+	}
+
+	for _, tag := range rule.tags {
+		if guest.hasTag(tag) {
+			matched = true
+			return
+		}
+	}
+	return
+}
+
+// Checks guest tags against the allowTags/denyTags config lists
+// A guest carrying any deny tag is refused, and when allow tags are set the guest must carry at least one
+func checkGuestTags(guest GuestConfig, allowTags []string, denyTags []string) (err error) {
+	for _, tag := range denyTags {
+		if guest.hasTag(tag) {
+			err = fmt.Errorf("guest has denied tag '%s'", tag)
+			return
+		}
+	}
+
+	if len(allowTags) == 0 {
+		return
+	}
+
+	for _, tag := range allowTags {
+		if guest.hasTag(tag) {
+			return
+		}
+	}
+
+	err = fmt.Errorf("guest has none of the allowed tags (%s)", strings.Join(allowTags, ", "))
+	return
+}
+
+// ###################################
+//	RESOURCE POOLS
+// ###################################
+
+// Retrieves names of the resource pools containing VMID from a PVE user.cfg
+//
+//	pool:<name>:<comment>:<vmid>,<vmid>,...:<storage>,...:
+func readGuestPools(userConfigPath string, VMID string) (pools []string, err error) {
+	userConfig, err := os.ReadFile(userConfigPath)
+	if err != nil {
+		return
+	}
+
+	for _, line := range strings.Split(string(userConfig), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ":")
+		if len(fields) < 4 || fields[0] != "pool" {
+			continue
+		}
+
+		for _, member := range strings.Split(fields[3], ",") {
+			if strings.TrimSpace(member) == VMID {
+				pools = append(pools, fields[1])
+				break
+			}
+		}
+	}
+	return
+}
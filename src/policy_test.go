@@ -0,0 +1,47 @@
+// wakeonlanpve
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestWakePolicyTargetVMIDs(t *testing.T) {
+	policy, err := newWakePolicy([]WakePolicyRule{
+		{TargetVMIDs: []string{"104", "200-299", "web-01", "db-2024"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	source := wakeSource{Interface: "vmbr0", IP: net.ParseIP("192.168.1.10")}
+	tests := []struct {
+		guest   GuestConfig
+		allowed bool
+	}{
+		{GuestConfig{VMID: "104", Type: "qemu-server", Name: "web01"}, true},
+		{GuestConfig{VMID: "105", Type: "qemu-server", Name: "web02"}, false},
+		{GuestConfig{VMID: "200", Type: "lxc", Name: "ct200"}, true},
+		{GuestConfig{VMID: "299", Type: "lxc", Name: "ct299"}, true},
+		{GuestConfig{VMID: "300", Type: "lxc", Name: "ct300"}, false},
+		{GuestConfig{VMID: "web-01", Type: guestTypeLibvirt, Name: "web-01"}, true},
+		{GuestConfig{VMID: "db-2024", Type: guestTypeLibvirt, Name: "db-2024"}, true},
+		{GuestConfig{VMID: "web-02", Type: guestTypeLibvirt, Name: "web-02"}, false},
+	}
+
+	for _, test := range tests {
+		err := policy.authorize(source, test.guest)
+		if test.allowed && err != nil {
+			t.Errorf("guest %s: unexpected denial: %v", test.guest.VMID, err)
+		} else if !test.allowed && err == nil {
+			t.Errorf("guest %s: expected denial", test.guest.VMID)
+		}
+	}
+}
+
+func TestWakePolicyInvalidVMIDRange(t *testing.T) {
+	_, err := newWakePolicy([]WakePolicyRule{{TargetVMIDs: []string{"299-200"}}})
+	if err == nil {
+		t.Errorf("expected error for reversed VMID range")
+	}
+}
@@ -0,0 +1,340 @@
+// wakeonlanpve
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Connection parameters for the Proxmox VE HTTP API
+type ProxmoxAPIParams struct {
+	URL            string `json:"url"`                // e.g. https://pve1.example.com:8006
+	TokenID        string `json:"tokenID"`            // e.g. wol@pve!wakeonlan
+	TokenSecret    string `json:"tokenSecret"`        // API token UUID
+	Node           string `json:"node"`               // Optional, looked up from cluster resources when empty
+	CACertFile     string `json:"caCertFile"`         // Optional PEM bundle to trust instead of system roots
+	InsecureTLS    bool   `json:"insecureSkipVerify"` // Skip certificate verification (self-signed default certs)
+	TimeoutSeconds int    `json:"timeoutSeconds"`     // Per request timeout
+}
+
+// Client for the subset of the Proxmox VE API used to control guests (implements GuestController)
+type ProxmoxAPIClient struct {
+	baseURL       string
+	authHeader    string
+	node          string
+	httpClient    *http.Client
+	statusTimeout time.Duration // Limit for all requests of a status check (statusTimeoutSeconds)
+	actionTimeout time.Duration // Limit for a power action including its task (startTimeoutSeconds)
+}
+
+// Default API request timeout if not set in config
+const defaultAPITimeoutSeconds int = 30
+
+// How often to poll a start task for completion
+const apiTaskPollInterval time.Duration = 500 * time.Millisecond
+
+// Creates API client from config parameters and the status/action time limits shared with the other backends
+func newProxmoxAPIClient(params ProxmoxAPIParams, statusTimeout time.Duration, actionTimeout time.Duration) (client *ProxmoxAPIClient, err error) {
+	if params.URL == "" {
+		err = fmt.Errorf("proxmox API url is required")
+		return
+	}
+	if params.TokenID == "" || params.TokenSecret == "" {
+		err = fmt.Errorf("proxmox API tokenID and tokenSecret are required")
+		return
+	}
+
+	timeoutSeconds := params.TimeoutSeconds
+	if timeoutSeconds <= 0 {
+		timeoutSeconds = defaultAPITimeoutSeconds
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: params.InsecureTLS}
+	if params.CACertFile != "" {
+		var caCerts []byte
+		caCerts, err = os.ReadFile(params.CACertFile)
+		if err != nil {
+			err = fmt.Errorf("failed to read proxmox API CA certificate file: %v", err)
+			return
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCerts) {
+			err = fmt.Errorf("no PEM certificates found in %s", params.CACertFile)
+			return
+		}
+	}
+
+	client = &ProxmoxAPIClient{
+		baseURL:    strings.TrimSuffix(params.URL, "/") + "/api2/json",
+		authHeader: "PVEAPIToken=" + params.TokenID + "=" + params.TokenSecret,
+		node:       params.Node,
+		httpClient: &http.Client{
+			Timeout:   time.Duration(timeoutSeconds) * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		statusTimeout: statusTimeout,
+		actionTimeout: actionTimeout,
+	}
+	return
+}
+
+// ###################################
+//	API REQUESTS
+// ###################################
+
+// Sends API request and decodes the "data" field of the response into result (if not nil)
+// The request is cancelled at the deadline of ctx, or after the per request timeout
+func (client *ProxmoxAPIClient) request(ctx context.Context, method string, path string, result any) (err error) {
+	request, err := http.NewRequestWithContext(ctx, method, client.baseURL+path, nil)
+	if err != nil {
+		return
+	}
+	request.Header.Set("Authorization", client.authHeader)
+	request.Header.Set("Accept", "application/json")
+
+	response, err := client.httpClient.Do(request)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		err = fmt.Errorf("failed to read response for %s %s: %v", method, path, err)
+		return
+	}
+
+	// API puts the reason for failures in the status line
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		err = fmt.Errorf("%s %s returned %s", method, path, response.Status)
+		return
+	}
+
+	if result == nil {
+		return
+	}
+
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	err = json.Unmarshal(responseBody, &envelope)
+	if err != nil {
+		err = fmt.Errorf("failed to parse response for %s %s: %v", method, path, err)
+		return
+	}
+
+	err = json.Unmarshal(envelope.Data, result)
+	if err != nil {
+		err = fmt.Errorf("unexpected response data for %s %s: %v", method, path, err)
+		return
+	}
+	return
+}
+
+// Converts config directory guest type to API path type
+func apiGuestType(VMTYPE string) (apiType string) {
+	if strings.Contains(VMTYPE, "lxc") {
+		apiType = "lxc"
+	} else {
+		apiType = "qemu"
+	}
+	return
+}
+
+// Retrieves the cluster node a guest currently lives on (configured node takes precedence)
+func (client *ProxmoxAPIClient) findGuestNode(ctx context.Context, VMID string) (node string, err error) {
+	if client.node != "" {
+		node = client.node
+		return
+	}
+
+	var resources []struct {
+		VMID int    `json:"vmid"`
+		Node string `json:"node"`
+	}
+	err = client.request(ctx, http.MethodGet, "/cluster/resources?type=vm", &resources)
+	if err != nil {
+		return
+	}
+
+	for _, resource := range resources {
+		if strconv.Itoa(resource.VMID) == VMID {
+			node = resource.Node
+			return
+		}
+	}
+
+	err = fmt.Errorf("guest %s not found in cluster resources", VMID)
+	return
+}
+
+// Retrieves current guest status (running, stopped), QEMU run state (paused, etc.), and config lock (suspended, backup, etc.)
+func (client *ProxmoxAPIClient) guestStatus(ctx context.Context, node string, apiType string, VMID string) (status string, qmpStatus string, lock string, err error) {
+	var current struct {
+		Status    string `json:"status"`
+		QMPStatus string `json:"qmpstatus"`
+		Lock      string `json:"lock"`
+	}
+	err = client.request(ctx, http.MethodGet, fmt.Sprintf("/nodes/%s/%s/%s/status/current", url.PathEscape(node), apiType, VMID), &current)
+	if err != nil {
+		return
+	}
+
+	status = current.Status
+	qmpStatus = current.QMPStatus
+	lock = current.Lock
+	return
+}
+
+// Requests a guest power action (start, resume, stop) and waits for the resulting task to finish
+func (client *ProxmoxAPIClient) guestAction(guest GuestConfig, action string) (err error) {
+	err = requireProxmoxGuest(guest)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), client.actionTimeout)
+	defer cancel()
+
+	node, err := client.findGuestNode(ctx, guest.VMID)
+	if err != nil {
+		return
+	}
+
+	var taskID string
+	err = client.request(ctx, http.MethodPost, fmt.Sprintf("/nodes/%s/%s/%s/status/%s", url.PathEscape(node), apiGuestType(guest.Type), guest.VMID, action), &taskID)
+	if err != nil {
+		return
+	}
+
+	err = client.waitForTask(ctx, node, taskID)
+	return
+}
+
+// Polls task status until it stops (or the deadline of ctx passes), returning the task exit status if it failed
+func (client *ProxmoxAPIClient) waitForTask(ctx context.Context, node string, taskID string) (err error) {
+	for {
+		var task struct {
+			Status     string `json:"status"`
+			ExitStatus string `json:"exitstatus"`
+		}
+		err = client.request(ctx, http.MethodGet, fmt.Sprintf("/nodes/%s/tasks/%s/status", url.PathEscape(node), url.PathEscape(taskID)), &task)
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("task %s still running after %s", taskID, client.actionTimeout)
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		if task.Status == "stopped" {
+			if task.ExitStatus != "OK" {
+				err = fmt.Errorf("task %s failed: %s", taskID, task.ExitStatus)
+			}
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			err = fmt.Errorf("task %s still running after %s", taskID, client.actionTimeout)
+			return
+		case <-time.After(apiTaskPollInterval):
+		}
+	}
+}
+
+// ###################################
+//	API CONTROLLER
+// ###################################
+
+func (client *ProxmoxAPIClient) Status(guest GuestConfig) (state GuestState, err error) {
+	err = requireProxmoxGuest(guest)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), client.statusTimeout)
+	defer cancel()
+
+	node, err := client.findGuestNode(ctx, guest.VMID)
+	if err != nil {
+		return
+	}
+
+	status, qmpStatus, lock, err := client.guestStatus(ctx, node, apiGuestType(guest.Type), guest.VMID)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case status == "running" && (qmpStatus == "paused" || qmpStatus == "prelaunch"):
+		state = guestPaused
+	case status == "running" && qmpStatus == "suspended":
+		state = guestSuspended
+	case status == "running":
+		state = guestRunning
+	case lock == "suspended":
+		state = guestHibernated
+	default:
+		state = guestStopped
+	}
+	return
+}
+
+func (client *ProxmoxAPIClient) Start(guest GuestConfig) (err error) {
+	err = client.guestAction(guest, "start")
+	return
+}
+
+func (client *ProxmoxAPIClient) Resume(guest GuestConfig) (err error) {
+	err = client.guestAction(guest, "resume")
+	return
+}
+
+// Sends system_wakeup through the VM monitor endpoint (token needs VM.Monitor)
+func (client *ProxmoxAPIClient) Wakeup(guest GuestConfig) (err error) {
+	err = requireProxmoxGuest(guest)
+	if err != nil {
+		return
+	}
+	if apiGuestType(guest.Type) != "qemu" {
+		err = fmt.Errorf("wakeup is only supported for VMs")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), client.actionTimeout)
+	defer cancel()
+
+	node, err := client.findGuestNode(ctx, guest.VMID)
+	if err != nil {
+		return
+	}
+
+	// Monitor command output is empty on success
+	var output string
+	err = client.request(ctx, http.MethodPost, fmt.Sprintf("/nodes/%s/qemu/%s/monitor?command=system_wakeup", url.PathEscape(node), guest.VMID), &output)
+	if err != nil {
+		return
+	}
+	if strings.TrimSpace(output) != "" {
+		err = fmt.Errorf("system_wakeup failed: %s", strings.TrimSpace(output))
+		return
+	}
+	return
+}
+
+func (client *ProxmoxAPIClient) Stop(guest GuestConfig) (err error) {
+	err = client.guestAction(guest, "stop")
+	return
+}
@@ -0,0 +1,300 @@
+// wakeonlanpve
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Local stand-in for the Proxmox VE API, responding with canned JSON per request path
+type fakeProxmoxAPI struct {
+	server    *httptest.Server
+	mutex     sync.Mutex
+	responses map[string][]fakeAPIResponse // Request "METHOD path" to responses, last one repeats
+	requests  []string
+	authSeen  []string
+}
+
+func newFakeProxmoxAPI(t *testing.T) (fake *fakeProxmoxAPI) {
+	fake = &fakeProxmoxAPI{responses: make(map[string][]fakeAPIResponse)}
+	fake.server = httptest.NewServer(http.HandlerFunc(fake.handle))
+	t.Cleanup(fake.server.Close)
+	return
+}
+
+type fakeAPIResponse struct {
+	statusCode int
+	body       string
+	delay      time.Duration // Wait before answering, to exceed client time limits
+}
+
+// Answers the request with the JSON bodies in order
+func (fake *fakeProxmoxAPI) respond(request string, bodies ...string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	for _, body := range bodies {
+		fake.responses[request] = append(fake.responses[request], fakeAPIResponse{statusCode: http.StatusOK, body: body})
+	}
+}
+
+// Answers the request with the JSON body after a delay
+func (fake *fakeProxmoxAPI) respondDelayed(request string, delay time.Duration, body string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.responses[request] = []fakeAPIResponse{{statusCode: http.StatusOK, body: body, delay: delay}}
+}
+
+// Answers the request with an HTTP error (API puts the reason in the status line)
+func (fake *fakeProxmoxAPI) respondError(request string, statusCode int, reason string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.responses[request] = []fakeAPIResponse{{statusCode: statusCode, body: reason}}
+}
+
+func (fake *fakeProxmoxAPI) handle(writer http.ResponseWriter, request *http.Request) {
+	fake.mutex.Lock()
+
+	requestKey := request.Method + " " + strings.TrimPrefix(request.URL.RequestURI(), "/api2/json")
+	fake.requests = append(fake.requests, requestKey)
+	fake.authSeen = append(fake.authSeen, request.Header.Get("Authorization"))
+
+	responses, found := fake.responses[requestKey]
+	if !found || len(responses) == 0 {
+		fake.mutex.Unlock()
+		http.Error(writer, "no such path", http.StatusNotImplemented)
+		return
+	}
+
+	response := responses[0]
+	if len(responses) > 1 {
+		fake.responses[requestKey] = responses[1:]
+	}
+	fake.mutex.Unlock()
+
+	select {
+	case <-time.After(response.delay):
+	case <-request.Context().Done():
+		return
+	}
+
+	writer.WriteHeader(response.statusCode)
+	fmt.Fprint(writer, response.body)
+}
+
+func newTestAPIClient(t *testing.T, fake *fakeProxmoxAPI, node string) (client *ProxmoxAPIClient) {
+	client, err := newProxmoxAPIClient(ProxmoxAPIParams{
+		URL:            fake.server.URL + "/",
+		TokenID:        "wol@pve!wakeonlan",
+		TokenSecret:    "8c3e51f4-0000-4000-8000-000000000000",
+		Node:           node,
+		TimeoutSeconds: 5,
+	}, 5*time.Second, 5*time.Second)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	return
+}
+
+func TestProxmoxAPITokenHeader(t *testing.T) {
+	fake := newFakeProxmoxAPI(t)
+	fake.respond("GET /nodes/pve1/qemu/104/status/current", `{"data":{"status":"stopped"}}`)
+
+	client := newTestAPIClient(t, fake, "pve1")
+	_, err := client.Status(GuestConfig{VMID: "104", Type: "qemu-server"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedHeader := "PVEAPIToken=wol@pve!wakeonlan=8c3e51f4-0000-4000-8000-000000000000"
+	if len(fake.authSeen) != 1 || fake.authSeen[0] != expectedHeader {
+		t.Errorf("expected authorization header '%s', got %v", expectedHeader, fake.authSeen)
+	}
+}
+
+func TestProxmoxAPIFindGuestNode(t *testing.T) {
+	fake := newFakeProxmoxAPI(t)
+	fake.respond("GET /cluster/resources?type=vm", `{"data":[{"vmid":100,"node":"pve1"},{"vmid":104,"node":"pve2"}]}`)
+
+	client := newTestAPIClient(t, fake, "")
+
+	node, err := client.findGuestNode(context.Background(), "104")
+	if err != nil || node != "pve2" {
+		t.Errorf("expected node pve2, got '%s' (err: %v)", node, err)
+	}
+
+	_, err = client.findGuestNode(context.Background(), "999")
+	if err == nil {
+		t.Errorf("expected error for guest missing from cluster resources")
+	}
+
+	// Configured node skips the lookup
+	requestCount := len(fake.requests)
+	client.node = "pve3"
+	node, err = client.findGuestNode(context.Background(), "104")
+	if err != nil || node != "pve3" || len(fake.requests) != requestCount {
+		t.Errorf("expected configured node pve3 without a request, got '%s' (err: %v, requests: %v)", node, err, fake.requests)
+	}
+}
+
+func TestProxmoxAPIStartWaitsForTask(t *testing.T) {
+	taskID := "UPID:pve1:000A1B2C:0001:6530A1B2:qmstart:104:wol@pve!wakeonlan:"
+
+	fake := newFakeProxmoxAPI(t)
+	fake.respond("POST /nodes/pve1/qemu/104/status/start", `{"data":"`+taskID+`"}`)
+	fake.respond("GET /nodes/pve1/tasks/"+strings.ReplaceAll(taskID, "!", "%21")+"/status",
+		`{"data":{"status":"running"}}`,
+		`{"data":{"status":"stopped","exitstatus":"OK"}}`)
+
+	client := newTestAPIClient(t, fake, "pve1")
+	err := client.Start(GuestConfig{VMID: "104", Type: "qemu-server"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v (requests: %v)", err, fake.requests)
+	}
+
+	if len(fake.requests) != 3 {
+		t.Errorf("expected start and two task polls, got %v", fake.requests)
+	}
+}
+
+func TestProxmoxAPIStartTaskFailed(t *testing.T) {
+	taskID := "UPID:pve1:000A1B2D:0001:6530A1B3:vzstart:200:wol@pve!wakeonlan:"
+
+	fake := newFakeProxmoxAPI(t)
+	fake.respond("POST /nodes/pve1/lxc/200/status/start", `{"data":"`+taskID+`"}`)
+	fake.respond("GET /nodes/pve1/tasks/"+strings.ReplaceAll(taskID, "!", "%21")+"/status",
+		`{"data":{"status":"stopped","exitstatus":"startup for container '200' failed"}}`)
+
+	client := newTestAPIClient(t, fake, "pve1")
+	err := client.Start(GuestConfig{VMID: "200", Type: "lxc"})
+	if err == nil || !strings.Contains(err.Error(), "startup for container '200' failed") {
+		t.Errorf("expected task exit status in error, got: %v", err)
+	}
+}
+
+func TestProxmoxAPIStartTimeout(t *testing.T) {
+	taskID := "UPID:pve1:000A1B2E:0001:6530A1B4:qmstart:104:wol@pve!wakeonlan:"
+
+	fake := newFakeProxmoxAPI(t)
+	fake.respond("POST /nodes/pve1/qemu/104/status/start", `{"data":"`+taskID+`"}`)
+	fake.respond("GET /nodes/pve1/tasks/"+strings.ReplaceAll(taskID, "!", "%21")+"/status", `{"data":{"status":"running"}}`)
+
+	// Task wait is limited by startTimeoutSeconds, not the per request timeout
+	client := newTestAPIClient(t, fake, "pve1")
+	client.actionTimeout = 1200 * time.Millisecond
+
+	startTime := time.Now()
+	err := client.Start(GuestConfig{VMID: "104", Type: "qemu-server"})
+	if err == nil || !strings.Contains(err.Error(), "still running after 1.2s") {
+		t.Errorf("expected task timeout error, got: %v", err)
+	}
+	if elapsed := time.Since(startTime); elapsed > 3*time.Second {
+		t.Errorf("expected start to give up after the action timeout, took %s", elapsed)
+	}
+}
+
+func TestProxmoxAPIStatusTimeout(t *testing.T) {
+	fake := newFakeProxmoxAPI(t)
+	fake.respondDelayed("GET /nodes/pve1/qemu/104/status/current", 3*time.Second, `{"data":{"status":"running"}}`)
+
+	// Status checks are limited by statusTimeoutSeconds, even if the per request timeout is longer
+	client := newTestAPIClient(t, fake, "pve1")
+	client.statusTimeout = 200 * time.Millisecond
+
+	startTime := time.Now()
+	_, err := client.Status(GuestConfig{VMID: "104", Type: "qemu-server"})
+	if err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Errorf("expected status deadline error, got: %v", err)
+	}
+	if elapsed := time.Since(startTime); elapsed > 2*time.Second {
+		t.Errorf("expected status to give up after the status timeout, took %s", elapsed)
+	}
+}
+
+func TestProxmoxAPIErrorStatus(t *testing.T) {
+	fake := newFakeProxmoxAPI(t)
+	fake.respondError("POST /nodes/pve1/qemu/104/status/start", http.StatusForbidden, "Permission check failed (/vms/104, VM.PowerMgmt)")
+
+	client := newTestAPIClient(t, fake, "pve1")
+	err := client.Start(GuestConfig{VMID: "104", Type: "qemu-server"})
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("expected error with 403 status, got: %v", err)
+	}
+
+	// Unknown paths are answered with 501
+	_, err = client.Status(GuestConfig{VMID: "105", Type: "qemu-server"})
+	if err == nil || !strings.Contains(err.Error(), "501") {
+		t.Errorf("expected error with 501 status, got: %v", err)
+	}
+}
+
+func TestProxmoxAPIStatusMapping(t *testing.T) {
+	tests := []struct {
+		response string
+		expected GuestState
+	}{
+		{`{"data":{"status":"running","qmpstatus":"running"}}`, guestRunning},
+		{`{"data":{"status":"running","qmpstatus":"paused"}}`, guestPaused},
+		{`{"data":{"status":"running","qmpstatus":"prelaunch"}}`, guestPaused},
+		{`{"data":{"status":"running","qmpstatus":"suspended"}}`, guestSuspended},
+		{`{"data":{"status":"stopped","lock":"suspended"}}`, guestHibernated},
+		{`{"data":{"status":"stopped","lock":"backup"}}`, guestStopped},
+		{`{"data":{"status":"stopped"}}`, guestStopped},
+	}
+
+	for _, test := range tests {
+		fake := newFakeProxmoxAPI(t)
+		fake.respond("GET /nodes/pve1/qemu/104/status/current", test.response)
+
+		client := newTestAPIClient(t, fake, "pve1")
+		state, err := client.Status(GuestConfig{VMID: "104", Type: "qemu-server"})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.response, err)
+			continue
+		}
+		if state != test.expected {
+			t.Errorf("%s: expected state %s, got %s", test.response, test.expected, state)
+		}
+	}
+}
+
+func TestProxmoxAPIWakeup(t *testing.T) {
+	fake := newFakeProxmoxAPI(t)
+	fake.respond("POST /nodes/pve1/qemu/104/monitor?command=system_wakeup", `{"data":""}`)
+	fake.respond("POST /nodes/pve1/qemu/105/monitor?command=system_wakeup", `{"data":"Error: guest is not suspended"}`)
+
+	client := newTestAPIClient(t, fake, "pve1")
+
+	err := client.Wakeup(GuestConfig{VMID: "104", Type: "qemu-server"})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	err = client.Wakeup(GuestConfig{VMID: "105", Type: "qemu-server"})
+	if err == nil || !strings.Contains(err.Error(), "not suspended") {
+		t.Errorf("expected monitor output in error, got: %v", err)
+	}
+}
+
+func TestProxmoxAPIRejectsLibvirtGuest(t *testing.T) {
+	fake := newFakeProxmoxAPI(t)
+	client := newTestAPIClient(t, fake, "pve1")
+
+	guest := GuestConfig{VMID: "webserver", Type: guestTypeLibvirt, Name: "webserver"}
+	_, err := client.Status(guest)
+	if err == nil || !strings.Contains(err.Error(), "libvirt domain") {
+		t.Errorf("expected libvirt guest to be rejected, got: %v", err)
+	}
+	err = client.Start(guest)
+	if err == nil || !strings.Contains(err.Error(), "libvirt domain") {
+		t.Errorf("expected libvirt guest to be rejected, got: %v", err)
+	}
+	if len(fake.requests) != 0 {
+		t.Errorf("expected no API requests for libvirt guest, got %v", fake.requests)
+	}
+}
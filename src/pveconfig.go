@@ -0,0 +1,181 @@
+// wakeonlanpve
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Guest information parsed from the current (non-snapshot, non-pending) section of a Proxmox guest config, or from libvirt domain XML
+type GuestConfig struct {
+	VMID       string
+	Type       string // Config directory name (qemu-server or lxc), or guestTypeLibvirt for libvirt domains
+	Name       string
+	ConfigPath string
+	Tags       []string
+	NICs       []GuestNIC
+}
+
+// Network interface parsed from a netN: line of a guest config
+type GuestNIC struct {
+	Key        string // netN
+	Model      string // virtio, e1000, veth, etc.
+	MACAddress string // Upper-case colon separated
+	Bridge     string
+	VLANTag    int // 0 if untagged
+	Firewall   bool
+	LinkDown   bool
+}
+
+// QEMU NIC models - written in config as model=MAC
+var qemuNICModels = map[string]bool{
+	"e1000":         true,
+	"e1000-82540em": true,
+	"e1000-82544gc": true,
+	"e1000-82545em": true,
+	"e1000e":        true,
+	"i82551":        true,
+	"i82557b":       true,
+	"i82559er":      true,
+	"ne2k_isa":      true,
+	"ne2k_pci":      true,
+	"pcnet":         true,
+	"rtl8139":       true,
+	"virtio":        true,
+	"vmxnet3":       true,
+}
+
+// ###################################
+//	PARSE GUEST CONFIG
+// ###################################
+
+// Parses a qemu-server or LXC .conf file into guest information
+// Only the current config is read - parsing stops at the first [snapshot]/[PENDING] section
+func parseGuestConfig(configFilePath string, configFileContents string) (guest GuestConfig, err error) {
+	guest.VMID = strings.TrimSuffix(filepath.Base(configFilePath), ".conf")
+	guest.Type = filepath.Base(filepath.Dir(configFilePath))
+	guest.ConfigPath = configFilePath
+
+	configLines := strings.Split(configFileContents, "\n")
+	for lineNumber, line := range configLines {
+		line = strings.TrimSpace(line)
+
+		// Start of snapshot or pending section - nothing after this is the running config
+		if strings.HasPrefix(line, "[") {
+			break
+		}
+
+		// Skip empty lines and description comments
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		switch {
+		case key == "name":
+			// QEMU conf
+			guest.Name = value
+		case key == "hostname":
+			// LXC conf
+			guest.Name = value
+		case key == "tags":
+			guest.Tags = parseGuestTags(value)
+		case isNICKey(key):
+			var nic GuestNIC
+			nic, err = parseGuestNIC(key, value)
+			if err != nil {
+				err = fmt.Errorf("line %d: %v", lineNumber+1, err)
+				return
+			}
+			guest.NICs = append(guest.NICs, nic)
+		}
+	}
+
+	return
+}
+
+// Splits a tags: value into individual tags (PVE writes ';' separated, older versions and hand edits may use ',' or spaces)
+func parseGuestTags(value string) (tags []string) {
+	tags = strings.FieldsFunc(value, func(r rune) bool {
+		return r == ';' || r == ',' || r == ' ' || r == '\t'
+	})
+	return
+}
+
+// Checks if guest carries tag (case-insensitive)
+func (guest GuestConfig) hasTag(tag string) (found bool) {
+	for _, guestTag := range guest.Tags {
+		if strings.EqualFold(guestTag, tag) {
+			found = true
+			return
+		}
+	}
+	return
+}
+
+// Checks if config key is a network interface (net0, net1, ...)
+func isNICKey(key string) (isNIC bool) {
+	index, found := strings.CutPrefix(key, "net")
+	if !found || index == "" {
+		return
+	}
+
+	_, err := strconv.Atoi(index)
+	isNIC = err == nil
+	return
+}
+
+// Parses the comma separated option list of a netN: line
+// QEMU: virtio=BC:24:11:00:00:01,bridge=vmbr0,firewall=1,tag=10
+// LXC:  name=eth0,bridge=vmbr0,hwaddr=BC:24:11:00:00:01,ip=dhcp,type=veth
+func parseGuestNIC(key string, value string) (nic GuestNIC, err error) {
+	nic.Key = key
+
+	for _, option := range strings.Split(value, ",") {
+		optionName, optionValue, _ := strings.Cut(strings.TrimSpace(option), "=")
+
+		switch {
+		case qemuNICModels[optionName]:
+			nic.Model = optionName
+			nic.MACAddress = strings.ToUpper(optionValue)
+		case optionName == "macaddr" || optionName == "hwaddr":
+			nic.MACAddress = strings.ToUpper(optionValue)
+		case optionName == "type":
+			nic.Model = optionValue
+		case optionName == "bridge":
+			nic.Bridge = optionValue
+		case optionName == "tag":
+			nic.VLANTag, err = strconv.Atoi(optionValue)
+			if err != nil {
+				err = fmt.Errorf("invalid VLAN tag '%s' on %s", optionValue, key)
+				return
+			}
+		case optionName == "firewall":
+			nic.Firewall = optionValue == "1"
+		case optionName == "link_down":
+			nic.LinkDown = optionValue == "1"
+		}
+	}
+
+	return
+}
+
+// Retrieves the NIC with the given MAC address, if the guest has one
+func (guest GuestConfig) findNIC(MACAddress string) (nic GuestNIC, found bool) {
+	for _, nic = range guest.NICs {
+		if nic.MACAddress == MACAddress {
+			found = true
+			return
+		}
+	}
+	nic = GuestNIC{}
+	return
+}
@@ -0,0 +1,87 @@
+// wakeonlanpve
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseGuestConfigQEMU(t *testing.T) {
+	configContents := `#Gaming VM
+#old NIC was virtio=AA:AA:AA:AA:AA:AA
+agent: 1
+boot: order=scsi0;net0
+description: moved from net0: virtio=CC:CC:CC:CC:CC:CC
+name: gaming
+net0: virtio=bc:24:11:00:00:01,bridge=vmbr0,firewall=1,tag=10
+net1: e1000=BC:24:11:00:00:02,bridge=vmbr1,link_down=1
+tags: wol;gaming
+vmgenid: 00000000-0000-0000-0000-000000000000
+
+[PENDING]
+net2: virtio=DD:DD:DD:DD:DD:DD,bridge=vmbr0
+
+[snapshot1]
+name: gaming-old
+net0: virtio=EE:EE:EE:EE:EE:EE,bridge=vmbr9
+`
+
+	guest, err := parseGuestConfig("/etc/pve/qemu-server/104.conf", configContents)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if guest.VMID != "104" || guest.Type != "qemu-server" || guest.Name != "gaming" {
+		t.Errorf("expected VM 104 (qemu-server) named gaming, got %s (%s) named %s", guest.VMID, guest.Type, guest.Name)
+	}
+	if !reflect.DeepEqual(guest.Tags, []string{"wol", "gaming"}) {
+		t.Errorf("expected tags [wol gaming], got %v", guest.Tags)
+	}
+
+	expectedNICs := []GuestNIC{
+		{Key: "net0", Model: "virtio", MACAddress: "BC:24:11:00:00:01", Bridge: "vmbr0", VLANTag: 10, Firewall: true},
+		{Key: "net1", Model: "e1000", MACAddress: "BC:24:11:00:00:02", Bridge: "vmbr1", LinkDown: true},
+	}
+	if !reflect.DeepEqual(guest.NICs, expectedNICs) {
+		t.Errorf("expected NICs %+v, got %+v", expectedNICs, guest.NICs)
+	}
+}
+
+func TestParseGuestConfigLXC(t *testing.T) {
+	configContents := `# container with MAC BC:24:11:FF:FF:FF in notes
+arch: amd64
+hostname: fileserver
+net0: name=eth0,bridge=vmbr0,hwaddr=BC:24:11:00:00:03,ip=dhcp,type=veth
+net1: name=eth1,bridge=vmbr2,firewall=1,hwaddr=bc:24:11:00:00:04,tag=20,type=veth
+ostype: debian
+
+[vzdump]
+hostname: fileserver-backup
+net0: name=eth0,bridge=vmbr0,hwaddr=BC:24:11:AA:AA:AA,type=veth
+`
+
+	guest, err := parseGuestConfig("/etc/pve/lxc/200.conf", configContents)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if guest.VMID != "200" || guest.Type != "lxc" || guest.Name != "fileserver" {
+		t.Errorf("expected LXC 200 named fileserver, got %s (%s) named %s", guest.VMID, guest.Type, guest.Name)
+	}
+
+	expectedNICs := []GuestNIC{
+		{Key: "net0", Model: "veth", MACAddress: "BC:24:11:00:00:03", Bridge: "vmbr0"},
+		{Key: "net1", Model: "veth", MACAddress: "BC:24:11:00:00:04", Bridge: "vmbr2", VLANTag: 20, Firewall: true},
+	}
+	if !reflect.DeepEqual(guest.NICs, expectedNICs) {
+		t.Errorf("expected NICs %+v, got %+v", expectedNICs, guest.NICs)
+	}
+}
+
+func TestParseGuestConfigInvalidVLANTag(t *testing.T) {
+	_, err := parseGuestConfig("/etc/pve/qemu-server/104.conf", "name: test\nnet0: virtio=BC:24:11:00:00:01,bridge=vmbr0,tag=ten\n")
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected invalid VLAN tag on line 2 to be rejected, got: %v", err)
+	}
+}
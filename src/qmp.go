@@ -0,0 +1,166 @@
+// wakeonlanpve
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+// Directory holding QEMU monitor sockets (<vmid>.qmp) if not set in config
+const defaultQMPSocketDir string = "/var/run/qemu-server"
+
+// Client for a single QEMU Machine Protocol session over a Unix socket
+type qmpSession struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+}
+
+// Generic QMP reply - events are skipped while waiting for a reply
+type qmpReply struct {
+	Return json.RawMessage `json:"return"`
+	Error  *struct {
+		Class       string `json:"class"`
+		Description string `json:"desc"`
+	} `json:"error"`
+	Event string `json:"event"`
+}
+
+// ###################################
+//	QMP SESSION
+// ###################################
+
+// Connects to the QMP socket of a VM and negotiates capabilities
+func openQMPSession(socketDir string, VMID string, timeout time.Duration) (session *qmpSession, err error) {
+	socketPath := filepath.Join(socketDir, VMID+".qmp")
+
+	conn, err := net.DialTimeout("unix", socketPath, timeout)
+	if err != nil {
+		err = fmt.Errorf("failed to connect to QMP socket: %v", err)
+		return
+	}
+
+	session = &qmpSession{conn: conn, reader: bufio.NewReader(conn), timeout: timeout}
+
+	// Server greets with its version and capabilities before accepting commands
+	var greeting struct {
+		QMP json.RawMessage `json:"QMP"`
+	}
+	err = session.readMessage(&greeting)
+	if err == nil && greeting.QMP == nil {
+		err = fmt.Errorf("unexpected greeting")
+	}
+	if err != nil {
+		session.close()
+		err = fmt.Errorf("invalid QMP greeting: %v", err)
+		return
+	}
+
+	// Leave capabilities negotiation mode
+	_, err = session.execute("qmp_capabilities")
+	if err != nil {
+		session.close()
+		return
+	}
+	return
+}
+
+func (session *qmpSession) close() {
+	session.conn.Close()
+}
+
+// Reads one JSON message (one per line)
+func (session *qmpSession) readMessage(message any) (err error) {
+	session.conn.SetReadDeadline(time.Now().Add(session.timeout))
+
+	line, err := session.reader.ReadBytes('\n')
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(line, message)
+	return
+}
+
+// Sends command and waits for its reply, returning the raw "return" value
+func (session *qmpSession) execute(command string) (result json.RawMessage, err error) {
+	request, err := json.Marshal(map[string]string{"execute": command})
+	if err != nil {
+		return
+	}
+
+	session.conn.SetWriteDeadline(time.Now().Add(session.timeout))
+	_, err = session.conn.Write(append(request, '\n'))
+	if err != nil {
+		err = fmt.Errorf("failed to send QMP command %s: %v", command, err)
+		return
+	}
+
+	for {
+		var reply qmpReply
+		err = session.readMessage(&reply)
+		if err != nil {
+			err = fmt.Errorf("failed to read QMP reply to %s: %v", command, err)
+			return
+		}
+
+		// Asynchronous events can arrive at any time
+		if reply.Event != "" {
+			continue
+		}
+
+		if reply.Error != nil {
+			err = fmt.Errorf("QMP command %s failed: %s: %s", command, reply.Error.Class, reply.Error.Description)
+			return
+		}
+
+		result = reply.Return
+		return
+	}
+}
+
+// ###################################
+//	QMP GUEST SUSPEND
+// ###################################
+
+// Retrieves the QEMU run state of the VM (running, paused, suspended, etc.)
+func queryQMPStatus(socketDir string, VMID string, timeout time.Duration) (runState string, err error) {
+	session, err := openQMPSession(socketDir, VMID, timeout)
+	if err != nil {
+		return
+	}
+	defer session.close()
+
+	result, err := session.execute("query-status")
+	if err != nil {
+		return
+	}
+
+	var status struct {
+		Status string `json:"status"`
+	}
+	err = json.Unmarshal(result, &status)
+	if err != nil {
+		err = fmt.Errorf("invalid query-status reply: %v", err)
+		return
+	}
+
+	runState = status.Status
+	return
+}
+
+// Wakes a VM that suspended itself to RAM (ACPI S3)
+func sendQMPWakeup(socketDir string, VMID string, timeout time.Duration) (err error) {
+	session, err := openQMPSession(socketDir, VMID, timeout)
+	if err != nil {
+		return
+	}
+	defer session.close()
+
+	_, err = session.execute("system_wakeup")
+	return
+}
@@ -0,0 +1,138 @@
+// wakeonlanpve
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Stand-in QMP server on <dir>/<vmid>.qmp, answering commands with canned replies
+// Every command is preceded by an asynchronous event, which clients must skip
+func startFakeQMPServer(t *testing.T, VMID string, replies map[string]string) (socketDir string, commands chan string) {
+	socketDir = t.TempDir()
+	commands = make(chan string, 16)
+
+	listener, err := net.Listen("unix", filepath.Join(socketDir, VMID+".qmp"))
+	if err != nil {
+		t.Fatalf("failed to listen on QMP socket: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeQMP(conn, replies, commands)
+		}
+	}()
+	return
+}
+
+func serveFakeQMP(conn net.Conn, replies map[string]string, commands chan string) {
+	defer conn.Close()
+
+	writer := bufio.NewWriter(conn)
+	writeLine := func(line string) {
+		writer.WriteString(line + "\n")
+		writer.Flush()
+	}
+
+	writeLine(`{"QMP": {"version": {"qemu": {"micro": 0, "minor": 2, "major": 8}, "package": "pve-qemu-kvm_8.2.2-1"}, "capabilities": []}}`)
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+
+		var request struct {
+			Execute string `json:"execute"`
+		}
+		json.Unmarshal(line, &request)
+		commands <- request.Execute
+
+		writeLine(`{"timestamp": {"seconds": 1700000000, "microseconds": 1}, "event": "RTC_CHANGE", "data": {"offset": 0}}`)
+
+		reply, found := replies[request.Execute]
+		if !found {
+			reply = `{"error": {"class": "CommandNotFound", "desc": "The command ` + request.Execute + ` has not been found"}}`
+		}
+		writeLine(reply)
+	}
+}
+
+// Collects the commands the stand-in received
+func receivedQMPCommands(commands chan string) (received []string) {
+	for {
+		select {
+		case command := <-commands:
+			received = append(received, command)
+		case <-time.After(100 * time.Millisecond):
+			return
+		}
+	}
+}
+
+func TestQueryQMPStatusSuspended(t *testing.T) {
+	socketDir, commands := startFakeQMPServer(t, "104", map[string]string{
+		"qmp_capabilities": `{"return": {}}`,
+		"query-status":     `{"return": {"status": "suspended", "singlestep": false, "running": true}}`,
+	})
+
+	runState, err := queryQMPStatus(socketDir, "104", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if runState != "suspended" {
+		t.Errorf("expected run state suspended, got '%s'", runState)
+	}
+
+	received := strings.Join(receivedQMPCommands(commands), ",")
+	if received != "qmp_capabilities,query-status" {
+		t.Errorf("expected capabilities negotiation before query-status, got %s", received)
+	}
+}
+
+func TestSendQMPWakeup(t *testing.T) {
+	socketDir, commands := startFakeQMPServer(t, "104", map[string]string{
+		"qmp_capabilities": `{"return": {}}`,
+		"system_wakeup":    `{"return": {}}`,
+	})
+
+	err := sendQMPWakeup(socketDir, "104", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	received := strings.Join(receivedQMPCommands(commands), ",")
+	if received != "qmp_capabilities,system_wakeup" {
+		t.Errorf("expected capabilities negotiation before system_wakeup, got %s", received)
+	}
+}
+
+func TestSendQMPWakeupError(t *testing.T) {
+	socketDir, _ := startFakeQMPServer(t, "104", map[string]string{
+		"qmp_capabilities": `{"return": {}}`,
+		"system_wakeup":    `{"error": {"class": "GenericError", "desc": "Unable to wake up: guest is not in suspended state"}}`,
+	})
+
+	err := sendQMPWakeup(socketDir, "104", time.Second)
+	if err == nil || !strings.Contains(err.Error(), "not in suspended state") {
+		t.Errorf("expected QMP error description in error, got: %v", err)
+	}
+}
+
+func TestQMPMissingSocket(t *testing.T) {
+	_, err := queryQMPStatus(t.TempDir(), "104", time.Second)
+	if err == nil {
+		t.Errorf("expected error for missing QMP socket")
+	}
+}
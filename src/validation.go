@@ -2,63 +2,258 @@
 package main
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"encoding/hex"
 	"fmt"
+	"net"
+	"strconv"
 	"strings"
 
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 )
 
 // ###################################
 //	VALIDATE PACKET
 // ###################################
 
-// Ensures received packet payload is present, its length is correct, and its payload matches hexadecimal characters
-// Extracts the first 12 hex characters from the payload
-func validatePacket(recvPacket gopacket.Packet) (MACAddress string, err error) {
+// Magic packet layout: 6 byte sync stream followed by 16 repetitions of the 6 byte target MAC
+const syncStreamLength int = 6
+const macRepetitions int = 16
+const magicPacketLength int = syncStreamLength + macRepetitions*6
+
+// EtherType for WOL frames sent directly at layer 2 (not registered with gopacket)
+const etherTypeWOL layers.EthernetType = 0x0842
+
+// Magic packet validation modes
+const (
+	validationStrict        string = "strict"        // Payload is exactly a magic packet (plus optional SecureOn password)
+	validationAllowTrailing string = "allowTrailing" // Magic packet must start the payload, any trailing bytes are ignored
+	validationSearchPayload string = "searchPayload" // Magic packet may appear anywhere in the payload
+)
+
+// Ensures validation mode from config is known - empty means strict
+func validateValidationMode(mode string) (err error) {
+	switch mode {
+	case "", validationStrict, validationAllowTrailing, validationSearchPayload:
+	default:
+		err = fmt.Errorf("unknown validation mode '%s': must be '%s', '%s', or '%s'", mode, validationStrict, validationAllowTrailing, validationSearchPayload)
+	}
+	return
+}
+
+// Ensures received packet payload is present and contains a well formed magic packet
+// Extracts the target MAC address from the payload, and the SecureOn password if one trails the MAC repetitions
+func validatePacket(recvPacket gopacket.Packet, validationMode string) (MACAddress string, SecureOnPassword string, err error) {
 	// Get payload from packet - skip if empty
-	payload := recvPacket.ApplicationLayer()
-	if payload == nil {
+	var payload []byte
+	if applicationLayer := recvPacket.ApplicationLayer(); applicationLayer != nil {
+		payload = applicationLayer.Payload()
+	} else if ethernetLayer, ok := recvPacket.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); ok && ethernetLayer.EthernetType == etherTypeWOL {
+		// Raw ethernet WOL frames carry the magic packet directly after the ethernet header
+		payload = ethernetLayer.Payload
+	} else if dot1QLayer, ok := recvPacket.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q); ok && dot1QLayer.Type == etherTypeWOL {
+		// Same for raw frames with an 802.1Q tag
+		payload = dot1QLayer.Payload
+	}
+	if len(payload) == 0 {
 		err = fmt.Errorf("payload is empty")
 		return
 	}
 
-	// Convert payload to hex
-	hexPayload := hex.EncodeToString(payload.Payload())
+	MACAddress, SecureOnPassword, err = parseMagicPacket(payload, validationMode)
+	return
+}
 
-	// Ensure payload length is expected WOL size
-	if len(hexPayload) != 204 {
-		err = fmt.Errorf("payload must be exactly 204 characters long")
-		return
+// Parses magic packet from raw payload bytes according to the validation mode
+func parseMagicPacket(payload []byte, validationMode string) (MACAddress string, SecureOnPassword string, err error) {
+	switch validationMode {
+	case "", validationStrict:
+		// Plain, 4 byte SecureOn, or 6 byte SecureOn
+		if len(payload) != magicPacketLength && len(payload) != magicPacketLength+4 && len(payload) != magicPacketLength+6 {
+			err = fmt.Errorf("payload is %d bytes, must be exactly %d bytes (or %d/%d with a SecureOn password)", len(payload), magicPacketLength, magicPacketLength+4, magicPacketLength+6)
+			return
+		}
+
+		MACAddress, SecureOnPassword, err = parseMagicPacketAt(payload, 0)
+	case validationAllowTrailing:
+		if len(payload) < magicPacketLength {
+			err = fmt.Errorf("payload is %d bytes, must be at least %d bytes", len(payload), magicPacketLength)
+			return
+		}
+
+		MACAddress, SecureOnPassword, err = parseMagicPacketAt(payload, 0)
+	case validationSearchPayload:
+		// Try every sync stream candidate, reporting the first failure if none are valid
+		syncStream := bytes.Repeat([]byte{0xff}, syncStreamLength)
+
+		var firstErr error
+		for offset := 0; offset+magicPacketLength <= len(payload); offset++ {
+			if !bytes.Equal(payload[offset:offset+syncStreamLength], syncStream) {
+				continue
+			}
+
+			MACAddress, SecureOnPassword, err = parseMagicPacketAt(payload, offset)
+			if err == nil {
+				return
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		if firstErr != nil {
+			err = fmt.Errorf("no magic packet found in %d byte payload (first candidate: %v)", len(payload), firstErr)
+		} else {
+			err = fmt.Errorf("no sync stream found in %d byte payload", len(payload))
+		}
+		MACAddress = ""
+		SecureOnPassword = ""
+	default:
+		err = fmt.Errorf("unknown validation mode '%s'", validationMode)
 	}
 
-	// Validate WOL packet payload prefix
-	if !strings.HasPrefix(hexPayload, "ffffffffffff") {
-		err = fmt.Errorf("payload does not have wakeonlan sync stream prefix")
+	return
+}
+
+// Verifies the sync stream and all MAC repetitions of a magic packet starting at offset
+// A SecureOn password is only extracted if exactly 4 or 6 bytes remain after the magic packet
+func parseMagicPacketAt(payload []byte, offset int) (MACAddress string, SecureOnPassword string, err error) {
+	if offset+magicPacketLength > len(payload) {
+		err = fmt.Errorf("magic packet at offset %d is truncated (payload is %d bytes)", offset, len(payload))
 		return
 	}
 
-	// Trim preamble from WOL payload
-	hexPayload = strings.TrimPrefix(hexPayload, "ffffffffffff")
+	// Validate sync stream
+	for position := offset; position < offset+syncStreamLength; position++ {
+		if payload[position] != 0xff {
+			err = fmt.Errorf("sync stream byte at offset %d is 0x%02x, expected 0xff", position, payload[position])
+			return
+		}
+	}
 
-	// Validate rest of payload is only hex
-	for _, char := range hexPayload {
-		switch {
-		case char >= '0' && char <= '9':
-		case char >= 'a' && char <= 'f':
-		case char >= 'A' && char <= 'F':
-		default:
-			err = fmt.Errorf("payload does not consist solely of hexadecimal characters")
+	// First repetition is the target MAC
+	targetMAC := payload[offset+syncStreamLength : offset+syncStreamLength+6]
+
+	// Validate every repetition matches the first
+	for repetition := 1; repetition < macRepetitions; repetition++ {
+		repetitionOffset := offset + syncStreamLength + repetition*6
+		repetitionMAC := payload[repetitionOffset : repetitionOffset+6]
+		if !bytes.Equal(repetitionMAC, targetMAC) {
+			err = fmt.Errorf("MAC repetition %d at offset %d is %s, expected %s", repetition+1, repetitionOffset, formatHexBytes(repetitionMAC), formatHexBytes(targetMAC))
 			return
 		}
 	}
 
-	// Format MAC address from payload with colons
-	for characterPosition := 0; characterPosition < 12; characterPosition += 2 {
-		if characterPosition > 0 {
-			MACAddress += ":"
+	MACAddress = formatHexBytes(targetMAC)
+
+	// Anything immediately after the 16 MAC repetitions is the SecureOn password
+	trailing := payload[offset+magicPacketLength:]
+	if len(trailing) == 4 || len(trailing) == 6 {
+		SecureOnPassword = formatHexBytes(trailing)
+	}
+
+	return
+}
+
+// Formats bytes as upper-case colon separated hex (AA:BB:CC...)
+func formatHexBytes(rawBytes []byte) (formatted string) {
+	formatted = strings.ToUpper(net.HardwareAddr(rawBytes).String())
+	return
+}
+
+// ###################################
+//	VALIDATE SECUREON PASSWORD
+// ###################################
+
+// Normalizes configured SecureOn passwords and their keys (VMID, libvirt domain name, or MAC address) to upper-case colon separated bytes
+// Passwords may be written with colons, dashes, or no separator at all, but must be 4 or 6 bytes long
+func parseSecureOnPasswords(configPasswords map[string]string, allowDomainNames bool) (passwords map[string]string, err error) {
+	passwords = make(map[string]string)
+
+	for target, password := range configPasswords {
+		hexPassword := strings.NewReplacer(":", "", "-", "").Replace(strings.TrimSpace(password))
+
+		var rawPassword []byte
+		rawPassword, err = hex.DecodeString(hexPassword)
+		if err != nil {
+			err = fmt.Errorf("password for '%s' is not hexadecimal: %v", target, err)
+			return
 		}
-		MACAddress += strings.ToUpper(hexPayload[characterPosition : characterPosition+2])
+		if len(rawPassword) != 4 && len(rawPassword) != 6 {
+			err = fmt.Errorf("password for '%s' must be 4 or 6 bytes long", target)
+			return
+		}
+
+		var passwordKey string
+		passwordKey, err = parseSecureOnTarget(target, allowDomainNames)
+		if err != nil {
+			return
+		}
+
+		passwords[passwordKey] = formatHexBytes(rawPassword)
+	}
+
+	return
+}
+
+// Converts a password key to the format used for lookups
+// MAC keys use the same format as MACs extracted from packets, VMIDs and libvirt domain names stay exactly as written
+func parseSecureOnTarget(target string, allowDomainNames bool) (passwordKey string, err error) {
+	target = strings.TrimSpace(target)
+
+	// Bare hex MAC (aabbccddeeff) is not accepted by ParseMAC
+	MAC, MACErr := net.ParseMAC(target)
+	if len(target) == 12 {
+		MAC, MACErr = hex.DecodeString(target)
+	}
+	if MACErr == nil && len(MAC) == 6 {
+		passwordKey = formatHexBytes(MAC)
+		return
+	}
+
+	VMID, numErr := strconv.Atoi(target)
+	if numErr == nil && VMID > 0 && strconv.Itoa(VMID) == target {
+		passwordKey = target
+		return
+	}
+
+	// Domain names are case-sensitive, like the VMID they are matched against
+	if allowDomainNames && validateVMInfo(target, guestTypeLibvirt, target) == nil {
+		passwordKey = target
+		return
+	}
+
+	if allowDomainNames {
+		err = fmt.Errorf("password key '%s' is not a MAC address, VMID, or libvirt domain name", target)
+	} else {
+		err = fmt.Errorf("password key '%s' is not a MAC address or VMID", target)
+	}
+	return
+}
+
+// Ensures the SecureOn password in a packet matches the one configured for the target VM or MAC
+// Targets without a configured password accept packets with or without a password
+func validateSecureOnPassword(SecureOnPassword string, MACAddress string, VMID string, passwords map[string]string) (err error) {
+	// MAC specific password takes precedence over VM password
+	expectedPassword, passwordRequired := passwords[MACAddress]
+	if !passwordRequired {
+		expectedPassword, passwordRequired = passwords[VMID]
+	}
+
+	if !passwordRequired {
+		return
+	}
+
+	if SecureOnPassword == "" {
+		err = fmt.Errorf("missing SecureOn password")
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(SecureOnPassword), []byte(expectedPassword)) != 1 {
+		err = fmt.Errorf("incorrect SecureOn password")
+		return
 	}
 
 	return
@@ -89,22 +284,29 @@ func validateVMInfo(VMID string, VMTYPE string, VMNAME string) (err error) {
 	}
 
 	// Sanity check received values for VM information
-	// Validate VMID
-	for _, char := range VMID {
-		switch {
-		case char >= '0' && char <= '9':
-		default:
-			err = fmt.Errorf("invalid VM ID (%s): ID does not consist solely of numeric characters (0-9)", VMID)
-			return
-		}
-	}
-
 	// Validate VM Type
-	if VMTYPE != "qemu-server" && VMTYPE != "lxc" {
-		err = fmt.Errorf("invalid VM Type (%s): must be 'qemu-server' or 'lxc'", VMTYPE)
+	if VMTYPE != "qemu-server" && VMTYPE != "lxc" && VMTYPE != guestTypeLibvirt {
+		err = fmt.Errorf("invalid VM Type (%s): must be 'qemu-server', 'lxc', or '%s'", VMTYPE, guestTypeLibvirt)
 		return
 	}
 
+	// Validate VMID - libvirt domains are identified by name instead of a number
+	if VMTYPE == guestTypeLibvirt {
+		if VMID != VMNAME {
+			err = fmt.Errorf("invalid VM ID (%s): libvirt domain ID must be the domain name (%s)", VMID, VMNAME)
+			return
+		}
+	} else {
+		for _, char := range VMID {
+			switch {
+			case char >= '0' && char <= '9':
+			default:
+				err = fmt.Errorf("invalid VM ID (%s): ID does not consist solely of numeric characters (0-9)", VMID)
+				return
+			}
+		}
+	}
+
 	// Validate VM Name
 	if len(VMNAME) > 255 {
 		err = fmt.Errorf("invalid VM Name (%s): must not be more than 255 characters", VMNAME)
@@ -117,8 +319,13 @@ func validateVMInfo(VMID string, VMTYPE string, VMNAME string) (err error) {
 		case char >= 'A' && char <= 'Z':
 		case char == '-':
 		case char == '.':
+		case char == '_' && VMTYPE == guestTypeLibvirt:
 		default:
-			err = fmt.Errorf("invalid VM Name (%s): must only contain alphanumeric, dash, or period characters", VMNAME)
+			if VMTYPE == guestTypeLibvirt {
+				err = fmt.Errorf("invalid VM Name (%s): must only contain alphanumeric, dash, underscore, or period characters", VMNAME)
+			} else {
+				err = fmt.Errorf("invalid VM Name (%s): must only contain alphanumeric, dash, or period characters", VMNAME)
+			}
 			return
 		}
 	}
@@ -0,0 +1,181 @@
+// wakeonlanpve
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseSecureOnPasswordKeys(t *testing.T) {
+	tests := []struct {
+		key         string
+		expectedKey string
+	}{
+		{"104", "104"},
+		{"aa:bb:cc:dd:ee:ff", "AA:BB:CC:DD:EE:FF"},
+		{"AA-BB-CC-DD-EE-FF", "AA:BB:CC:DD:EE:FF"},
+		{"aabb.ccdd.eeff", "AA:BB:CC:DD:EE:FF"},
+		{"aabbccddeeff", "AA:BB:CC:DD:EE:FF"},
+		{" aabbccddeeff ", "AA:BB:CC:DD:EE:FF"},
+	}
+
+	for _, test := range tests {
+		passwords, err := parseSecureOnPasswords(map[string]string{test.key: "01020304"}, false)
+		if err != nil {
+			t.Errorf("key '%s': unexpected error: %v", test.key, err)
+			continue
+		}
+		if passwords[test.expectedKey] != "01:02:03:04" {
+			t.Errorf("key '%s': expected password under '%s', got %v", test.key, test.expectedKey, passwords)
+		}
+	}
+}
+
+func TestParseSecureOnPasswordRejectsUnknownKeys(t *testing.T) {
+	for _, key := range []string{"aabbccddeefg", "aa:bb:cc:dd:ee", "0104", "-104", "vm104", ""} {
+		_, err := parseSecureOnPasswords(map[string]string{key: "01020304"}, false)
+		if err == nil {
+			t.Errorf("key '%s': expected error, got none", key)
+		}
+	}
+}
+
+func TestValidateSecureOnPassword(t *testing.T) {
+	passwords, err := parseSecureOnPasswords(map[string]string{
+		"104":          "01:02:03:04",
+		"bc2411000002": "0a0b0c0d0e0f",
+	}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		password   string
+		MACAddress string
+		VMID       string
+		allowed    bool
+	}{
+		{"01:02:03:04", "BC:24:11:00:00:01", "104", true},
+		{"", "BC:24:11:00:00:01", "104", false},
+		{"01:02:03:05", "BC:24:11:00:00:01", "104", false},
+		{"0A:0B:0C:0D:0E:0F", "BC:24:11:00:00:02", "105", true},
+		{"", "BC:24:11:00:00:02", "105", false},
+		{"", "BC:24:11:00:00:03", "106", true},
+	}
+
+	for _, test := range tests {
+		err := validateSecureOnPassword(test.password, test.MACAddress, test.VMID, passwords)
+		if test.allowed && err != nil {
+			t.Errorf("%s/%s with password '%s': unexpected error: %v", test.VMID, test.MACAddress, test.password, err)
+		} else if !test.allowed && err == nil {
+			t.Errorf("%s/%s with password '%s': expected rejection", test.VMID, test.MACAddress, test.password)
+		}
+	}
+}
+
+func TestValidateSecureOnPasswordLibvirtDomain(t *testing.T) {
+	passwords, err := parseSecureOnPasswords(map[string]string{"webserver": "01:02:03:04", "Web_01": "05:06:07:08"}, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Domain name is the VMID of libvirt guests
+	MACAddress := "52:54:00:AA:BB:CC"
+	err = validateSecureOnPassword("", MACAddress, "webserver", passwords)
+	if err == nil {
+		t.Errorf("expected missing password to be rejected for domain webserver")
+	}
+	err = validateSecureOnPassword("01:02:03:04", MACAddress, "webserver", passwords)
+	if err != nil {
+		t.Errorf("unexpected error for domain webserver: %v", err)
+	}
+	err = validateSecureOnPassword("", MACAddress, "Web_01", passwords)
+	if err == nil {
+		t.Errorf("expected missing password to be rejected for domain Web_01")
+	}
+
+	// Domain names are only accepted with a backend that controls libvirt guests, and must be valid names
+	_, err = parseSecureOnPasswords(map[string]string{"webserver": "01:02:03:04"}, false)
+	if err == nil {
+		t.Errorf("expected domain name key to be rejected without libvirt support")
+	}
+	_, err = parseSecureOnPasswords(map[string]string{"web server": "01:02:03:04"}, true)
+	if err == nil {
+		t.Errorf("expected invalid domain name key to be rejected")
+	}
+}
+
+// Builds a magic packet for the target MAC, surrounded by prefix and trailing bytes
+func buildMagicPacket(targetMAC []byte, prefix []byte, trailing []byte) (payload []byte) {
+	payload = append(payload, prefix...)
+	payload = append(payload, bytes.Repeat([]byte{0xff}, syncStreamLength)...)
+	payload = append(payload, bytes.Repeat(targetMAC, macRepetitions)...)
+	payload = append(payload, trailing...)
+	return
+}
+
+// Copy of payload with the byte at offset replaced
+func corruptByte(payload []byte, offset int, value byte) (corrupted []byte) {
+	corrupted = append([]byte(nil), payload...)
+	corrupted[offset] = value
+	return
+}
+
+func TestParseMagicPacket(t *testing.T) {
+	targetMAC := []byte{0xbc, 0x24, 0x11, 0x00, 0x00, 0x02}
+	plain := buildMagicPacket(targetMAC, nil, nil)
+	prefix := []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07}
+
+	tests := []struct {
+		name             string
+		mode             string
+		payload          []byte
+		expectedMAC      string
+		expectedPassword string
+		expectedError    string // Substring of the error, including the reported offset
+	}{
+		{"strict plain", validationStrict, plain, "BC:24:11:00:00:02", "", ""},
+		{"default mode is strict", "", plain, "BC:24:11:00:00:02", "", ""},
+		{"strict 4 byte SecureOn", validationStrict, buildMagicPacket(targetMAC, nil, []byte{1, 2, 3, 4}), "BC:24:11:00:00:02", "01:02:03:04", ""},
+		{"strict 6 byte SecureOn", validationStrict, buildMagicPacket(targetMAC, nil, []byte{1, 2, 3, 4, 5, 6}), "BC:24:11:00:00:02", "01:02:03:04:05:06", ""},
+		{"strict trailing bytes", validationStrict, buildMagicPacket(targetMAC, nil, []byte{1, 2, 3, 4, 5}), "", "", "payload is 107 bytes, must be exactly 102 bytes"},
+		{"strict truncated", validationStrict, plain[:60], "", "", "payload is 60 bytes"},
+		{"strict short sync stream", validationStrict, corruptByte(plain, 3, 0x00), "", "", "sync stream byte at offset 3 is 0x00"},
+		{"strict repetition mismatch", validationStrict, corruptByte(plain, 6+8*6+5, 0x03), "", "", "MAC repetition 9 at offset 54 is BC:24:11:00:00:03"},
+		{"strict last repetition mismatch", validationStrict, corruptByte(plain, 96, 0xaa), "", "", "MAC repetition 16 at offset 96"},
+		{"allowTrailing ignores trailing bytes", validationAllowTrailing, buildMagicPacket(targetMAC, nil, bytes.Repeat([]byte{0xee}, 10)), "BC:24:11:00:00:02", "", ""},
+		{"allowTrailing 4 byte SecureOn", validationAllowTrailing, buildMagicPacket(targetMAC, nil, []byte{1, 2, 3, 4}), "BC:24:11:00:00:02", "01:02:03:04", ""},
+		{"allowTrailing truncated", validationAllowTrailing, plain[:101], "", "", "payload is 101 bytes, must be at least 102 bytes"},
+		{"allowTrailing requires packet at start", validationAllowTrailing, buildMagicPacket(targetMAC, prefix, nil), "", "", "sync stream byte at offset 0 is 0x00"},
+		{"allowTrailing repetition mismatch", validationAllowTrailing, corruptByte(buildMagicPacket(targetMAC, nil, []byte{0xee}), 12, 0x00), "", "", "MAC repetition 2 at offset 12"},
+		{"searchPayload after prefix", validationSearchPayload, buildMagicPacket(targetMAC, prefix, nil), "BC:24:11:00:00:02", "", ""},
+		{"searchPayload 6 byte SecureOn after prefix", validationSearchPayload, buildMagicPacket(targetMAC, prefix, []byte{1, 2, 3, 4, 5, 6}), "BC:24:11:00:00:02", "01:02:03:04:05:06", ""},
+		{"searchPayload sync stream longer than 6 bytes", validationSearchPayload, buildMagicPacket(targetMAC, []byte{0xff}, nil), "BC:24:11:00:00:02", "", ""},
+		{"searchPayload repetition mismatch", validationSearchPayload, corruptByte(buildMagicPacket(targetMAC, prefix, nil), 8+6+6, 0x00), "", "", "first candidate: MAC repetition 2 at offset 20"},
+		{"searchPayload no sync stream", validationSearchPayload, append(prefix, plain[6:]...), "", "", "no sync stream found in 104 byte payload"},
+		{"searchPayload short sync stream", validationSearchPayload, corruptByte(buildMagicPacket(targetMAC, prefix, nil), 8+5, 0x00), "", "", "no sync stream found"},
+		{"unknown mode", "lenient", plain, "", "", "unknown validation mode 'lenient'"},
+	}
+
+	for _, test := range tests {
+		MACAddress, SecureOnPassword, err := parseMagicPacket(test.payload, test.mode)
+		if test.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+				t.Errorf("%s: expected error containing '%s', got: %v", test.name, test.expectedError, err)
+			}
+			if MACAddress != "" || SecureOnPassword != "" {
+				t.Errorf("%s: expected no result with error, got MAC '%s' password '%s'", test.name, MACAddress, SecureOnPassword)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if MACAddress != test.expectedMAC || SecureOnPassword != test.expectedPassword {
+			t.Errorf("%s: expected MAC '%s' password '%s', got MAC '%s' password '%s'", test.name, test.expectedMAC, test.expectedPassword, MACAddress, SecureOnPassword)
+		}
+	}
+}
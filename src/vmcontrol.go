@@ -2,16 +2,108 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os/exec"
 	"strings"
+	"time"
 )
 
+// Power state of a guest as reported by a controller
+type GuestState string
+
+const (
+	guestStopped    GuestState = "stopped"
+	guestRunning    GuestState = "running"
+	guestPaused     GuestState = "paused"     // VM execution paused (qm suspend/pause)
+	guestHibernated GuestState = "hibernated" // VM suspended to disk (qm suspend --todisk)
+	guestFrozen     GuestState = "frozen"     // LXC processes frozen (pct suspend)
+	guestSuspended  GuestState = "suspended"  // VM suspended to RAM by the guest OS (ACPI S3)
+)
+
+// Power control for guests - one implementation per hypervisor integration
+type GuestController interface {
+	Status(guest GuestConfig) (state GuestState, err error)
+	Start(guest GuestConfig) (err error)
+	Resume(guest GuestConfig) (err error)
+	Wakeup(guest GuestConfig) (err error)
+	Stop(guest GuestConfig) (err error)
+}
+
+// Power backend names for config
+const (
+	backendCLI   string = "cli"   // qm/pct on the local node
+	backendAPI   string = "api"   // Proxmox VE HTTP API
+	backendFake  string = "fake"  // In-memory guests, nothing is started
+	backendVirsh string = "virsh" // virsh on a plain libvirt/KVM host
+)
+
+// Command timeouts and retry policy if not set in config
+const defaultStatusTimeoutSeconds int = 15
+const defaultStartTimeoutSeconds int = 120
+const defaultStartAttempts int = 3
+const defaultRetryBackoffSeconds int = 5
+
+// Retry policy for transient power control failures
+type retryPolicy struct {
+	attempts int           // Total attempts including the first
+	backoff  time.Duration // Wait before the second attempt, doubled for every attempt after
+}
+
+// Retry policy used by powerOn
+var powerRetry retryPolicy = retryPolicy{attempts: 1}
+
+// Waits between retry attempts (replaced in tests to record the backoff)
+var retrySleep func(time.Duration) = time.Sleep
+
+// Creates the guest controller selected in config
+func newGuestController(config Config) (controller GuestController, err error) {
+	statusTimeout := time.Duration(config.StatusTimeoutSeconds) * time.Second
+	actionTimeout := time.Duration(config.StartTimeoutSeconds) * time.Second
+
+	switch config.PowerBackend {
+	case "", backendCLI:
+		controller = &cliController{statusTimeout: statusTimeout, actionTimeout: actionTimeout, qmpSocketDir: config.QMPSocketDir}
+	case backendAPI:
+		controller, err = newProxmoxAPIClient(config.ProxmoxAPI, statusTimeout, actionTimeout)
+	case backendFake:
+		controller = newFakeController()
+	case backendVirsh:
+		controller = &virshController{statusTimeout: statusTimeout, actionTimeout: actionTimeout}
+	default:
+		err = fmt.Errorf("unknown power backend '%s': must be '%s', '%s', '%s', or '%s'", config.PowerBackend, backendCLI, backendAPI, backendFake, backendVirsh)
+	}
+	return
+}
+
+// Ensures guest is a Proxmox VM/LXC, libvirt domains are not known to qm/pct or the Proxmox API
+func requireProxmoxGuest(guest GuestConfig) (err error) {
+	if guest.Type == guestTypeLibvirt {
+		err = fmt.Errorf("libvirt domain %s can only be controlled by the '%s' power backend", guest.VMID, backendVirsh)
+	}
+	return
+}
+
+// Display name for guest type in messages
+func guestTypeName(VMTYPE string) (TYPENAME string) {
+	if strings.Contains(VMTYPE, "lxc") {
+		TYPENAME = "LXC"
+	} else if VMTYPE == guestTypeLibvirt {
+		TYPENAME = "Domain"
+	} else {
+		TYPENAME = "VM"
+	}
+	return
+}
+
 // ###################################
 //	POWER ON VM
 // ###################################
 
-func powerOn(VMCMD string, TYPENAME string, VMID string, VMNAME string) (err error) {
+// Starts (or resumes) guest through the controller if it is not already running
+// Dry run only checks the guest status and logs the action that would have been taken
+func powerOn(controller GuestController, guest GuestConfig, dryRun bool) (err error) {
 	// Recover from panic
 	defer func() {
 		if r := recover(); r != nil {
@@ -19,29 +111,261 @@ func powerOn(VMCMD string, TYPENAME string, VMID string, VMNAME string) (err err
 		}
 	}()
 
+	TYPENAME := guestTypeName(guest.Type)
+
 	// Check if VM is already running
-	cmd := exec.Command(VMCMD, "status", VMID)
-	stdout, err := cmd.CombinedOutput()
+	var state GuestState
+	err = retryTransient(fmt.Sprintf("to check status of %s %s - %s", TYPENAME, guest.VMID, guest.Name), func() (err error) {
+		state, err = controller.Status(guest)
+		return
+	})
 	if err != nil {
-		err = fmt.Errorf("failed to check status of %s %s - %s: %v", TYPENAME, VMID, VMNAME, err)
+		err = fmt.Errorf("failed to check status of %s %s - %s: %v", TYPENAME, guest.VMID, guest.Name, err)
 		return
 	}
 
-	// Log and return if already running
-	if strings.Contains(string(stdout), "running") {
-		err = fmt.Errorf("already running: %s %s - %s", TYPENAME, VMID, VMNAME)
+	// Action depends on the state the guest is in
+	var action, actionDone string
+	var actionFunc func(GuestConfig) error
+	switch state {
+	case guestRunning:
+		// Log and return if already running
+		err = fmt.Errorf("already running: %s %s - %s", TYPENAME, guest.VMID, guest.Name)
 		return
+	case guestPaused:
+		action, actionDone, actionFunc = "resume paused", "Resumed paused", controller.Resume
+	case guestFrozen:
+		action, actionDone, actionFunc = "unfreeze", "Unfroze", controller.Resume
+	case guestSuspended:
+		// Guest OS is still "running" from the hypervisor's view, only a wakeup event brings it out of S3
+		action, actionDone, actionFunc = "wake suspended", "Woke suspended", controller.Wakeup
+	case guestHibernated:
+		// Starting a hibernated VM restores its saved memory state
+		action, actionDone, actionFunc = "restore hibernated", "Restored hibernated", controller.Start
+	default:
+		action, actionDone, actionFunc = "start", "Powered on", controller.Start
 	}
 
-	// Start the VM based on VMID
-	cmd = exec.Command(VMCMD, "start", VMID)
-	_, err = cmd.CombinedOutput()
+	if dryRun {
+		logMessage("Dry run: would %s %s %s - %s", action, TYPENAME, guest.VMID, guest.Name)
+		return
+	}
+
+	err = retryTransient(fmt.Sprintf("to %s %s %s - %s", action, TYPENAME, guest.VMID, guest.Name), func() error {
+		return actionFunc(guest)
+	})
 	if err != nil {
-		err = fmt.Errorf("failed to start %s %s - %s: %v", TYPENAME, VMID, VMNAME, err)
+		err = fmt.Errorf("failed to %s %s %s - %s: %v", action, TYPENAME, guest.VMID, guest.Name, err)
 		return
 	}
 
 	// Show progress to user
-	logMessage("Powered on %s %s - %s", TYPENAME, VMID, VMNAME)
+	logMessage("%s %s %s - %s", actionDone, TYPENAME, guest.VMID, guest.Name)
+	return
+}
+
+// ###################################
+//	TIMEOUTS AND RETRIES
+// ###################################
+
+// Returned when a power control command is killed for running too long
+var errCommandTimeout = errors.New("command timed out")
+
+// Runs action until it succeeds, fails with a non-transient error, or the retry policy attempts are used up
+// Every retry and the final outcome after a retry are logged
+func retryTransient(description string, action func() error) (err error) {
+	backoff := powerRetry.backoff
+
+	for attempt := 1; ; attempt++ {
+		err = action()
+		if err == nil {
+			if attempt > 1 {
+				logMessage("Succeeded %s on attempt %d/%d", description, attempt, powerRetry.attempts)
+			}
+			return
+		}
+
+		if !isTransientError(err) {
+			return
+		}
+
+		if attempt >= powerRetry.attempts {
+			if powerRetry.attempts > 1 {
+				err = fmt.Errorf("giving up after %d attempt(s): %v", attempt, err)
+			}
+			return
+		}
+
+		logMessage("Transient failure %s (attempt %d/%d), retrying in %s: %v", description, attempt, powerRetry.attempts, backoff, err)
+		retrySleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Classifies failures that are likely to succeed if tried again (guest locked by backup/migration, cluster filesystem lock contention)
+// Command timeouts are not transient - the killed command may have partially completed
+func isTransientError(err error) (transient bool) {
+	if errors.Is(err, errCommandTimeout) {
+		return
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, transientMessage := range []string{
+		"is locked",            // VM is locked (backup)
+		"can't lock file",      // can't lock file '/var/lock/qemu-server/lock-104.conf' - got timeout
+		"cfs-lock",             // cfs-lock 'file-user_cfg' error: got lock request timeout
+		"got timeout",          // lock acquisition timeouts
+		"got lock request",     // pmxcfs lock requests
+		"resource temporarily", // EAGAIN from tools
+		"503 service unavailable",
+	} {
+		if strings.Contains(message, transientMessage) {
+			transient = true
+			return
+		}
+	}
+	return
+}
+
+// Runs command with timeout, including command output in errors
+func runCommand(timeout time.Duration, command string, args ...string) (output string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, command, args...)
+	stdout, err := cmd.CombinedOutput()
+	output = string(stdout)
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("%s %s: %w after %s", command, strings.Join(args, " "), errCommandTimeout, timeout)
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("%v: %s", err, strings.TrimSpace(output))
+		return
+	}
+	return
+}
+
+// ###################################
+//	CLI CONTROLLER
+// ###################################
+
+// Controls guests on the local node using qm (VMs) and pct (LXCs)
+type cliController struct {
+	statusTimeout time.Duration
+	actionTimeout time.Duration
+	qmpSocketDir  string
+}
+
+// Command for guest type
+func (controller *cliController) command(guest GuestConfig) (VMCMD string) {
+	if strings.Contains(guest.Type, "lxc") {
+		VMCMD = "pct"
+	} else {
+		VMCMD = "qm"
+	}
+	return
+}
+
+// Runs a qm/pct subcommand against the guest, including command output in errors
+func (controller *cliController) run(guest GuestConfig, timeout time.Duration, subcommand string, options ...string) (output string, err error) {
+	err = requireProxmoxGuest(guest)
+	if err != nil {
+		return
+	}
+
+	args := append([]string{subcommand, guest.VMID}, options...)
+	output, err = runCommand(timeout, controller.command(guest), args...)
+	return
+}
+
+func (controller *cliController) Status(guest GuestConfig) (state GuestState, err error) {
+	output, err := controller.run(guest, controller.statusTimeout, "status", "--verbose")
+	if err != nil {
+		return
+	}
+
+	state = parseVerboseStatus(output)
+
+	// Guests suspended to RAM still show as running, ask QEMU for its run state
+	if state == guestRunning && controller.command(guest) == "qm" {
+		runState, qmpErr := queryQMPStatus(controller.qmpSocketDir, guest.VMID, controller.statusTimeout)
+		if qmpErr != nil {
+			logMessage("Unable to query QMP status of VM %s - %s, assuming running: %v", guest.VMID, guest.Name, qmpErr)
+		} else if runState == "suspended" {
+			state = guestSuspended
+		}
+	}
+
+	// pct status does not report frozen containers, ask LXC directly
+	if state == guestRunning && controller.command(guest) == "pct" {
+		var lxcState string
+		lxcState, err = runCommand(controller.statusTimeout, "lxc-info", "--name", guest.VMID, "--state", "--no-humanize")
+		if err != nil {
+			return
+		}
+		if strings.TrimSpace(lxcState) == "FROZEN" {
+			state = guestFrozen
+		}
+	}
+	return
+}
+
+// Parses "key: value" output of qm/pct status --verbose into a guest state
+//
+//	status: running|stopped
+//	qmpstatus: running|paused|prelaunch|suspended|... (VMs only, while running)
+//	lock: suspended (VMs only, when hibernated)
+func parseVerboseStatus(output string) (state GuestState) {
+	statusFields := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		statusFields[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+
+	switch {
+	case statusFields["status"] == "running" && (statusFields["qmpstatus"] == "paused" || statusFields["qmpstatus"] == "prelaunch"):
+		state = guestPaused
+	case statusFields["status"] == "running" && statusFields["qmpstatus"] == "suspended":
+		state = guestSuspended
+	case statusFields["status"] == "running":
+		state = guestRunning
+	case statusFields["lock"] == "suspended":
+		state = guestHibernated
+	default:
+		state = guestStopped
+	}
+	return
+}
+
+func (controller *cliController) Start(guest GuestConfig) (err error) {
+	_, err = controller.run(guest, controller.actionTimeout, "start")
+	return
+}
+
+func (controller *cliController) Resume(guest GuestConfig) (err error) {
+	_, err = controller.run(guest, controller.actionTimeout, "resume")
+	return
+}
+
+// Sends ACPI wakeup directly over the QMP socket, qm has no equivalent command
+func (controller *cliController) Wakeup(guest GuestConfig) (err error) {
+	err = requireProxmoxGuest(guest)
+	if err != nil {
+		return
+	}
+	if controller.command(guest) != "qm" {
+		err = fmt.Errorf("wakeup is only supported for VMs")
+		return
+	}
+	err = sendQMPWakeup(controller.qmpSocketDir, guest.VMID, controller.actionTimeout)
+	return
+}
+
+func (controller *cliController) Stop(guest GuestConfig) (err error) {
+	_, err = controller.run(guest, controller.actionTimeout, "stop")
 	return
 }
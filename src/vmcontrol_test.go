@@ -0,0 +1,266 @@
+// wakeonlanpve
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Controller reporting a fixed state, whose actions fail with actionErr for the first failures calls
+type stubController struct {
+	mutex     sync.Mutex
+	state     GuestState
+	statusErr error
+	actionErr error
+	failures  int
+	calls     []string
+}
+
+func (controller *stubController) Status(guest GuestConfig) (state GuestState, err error) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	controller.calls = append(controller.calls, "status")
+	state = controller.state
+	err = controller.statusErr
+	return
+}
+
+// Records the action, failing while failures remain
+func (controller *stubController) action(name string) (err error) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	controller.calls = append(controller.calls, name)
+	if controller.failures > 0 {
+		controller.failures--
+		err = controller.actionErr
+	}
+	return
+}
+
+func (controller *stubController) Start(guest GuestConfig) (err error) {
+	err = controller.action("start")
+	return
+}
+
+func (controller *stubController) Resume(guest GuestConfig) (err error) {
+	err = controller.action("resume")
+	return
+}
+
+func (controller *stubController) Wakeup(guest GuestConfig) (err error) {
+	err = controller.action("wakeup")
+	return
+}
+
+func (controller *stubController) Stop(guest GuestConfig) (err error) {
+	err = controller.action("stop")
+	return
+}
+
+// Sets the retry policy for the test, recording every backoff wait instead of sleeping
+func setTestRetryPolicy(t *testing.T, policy retryPolicy) (sleeps *[]time.Duration) {
+	previousPolicy, previousSleep := powerRetry, retrySleep
+	t.Cleanup(func() {
+		powerRetry, retrySleep = previousPolicy, previousSleep
+	})
+
+	sleeps = new([]time.Duration)
+	powerRetry = policy
+	retrySleep = func(backoff time.Duration) {
+		*sleeps = append(*sleeps, backoff)
+	}
+	return
+}
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		err       error
+		transient bool
+	}{
+		{fmt.Errorf("exit status 2: VM is locked (backup)"), true},
+		{fmt.Errorf("exit status 255: can't lock file '/var/lock/qemu-server/lock-104.conf' - got timeout"), true},
+		{fmt.Errorf("cfs-lock 'file-user_cfg' error: got lock request timeout"), true},
+		{fmt.Errorf("exit status 1: Resource temporarily unavailable"), true},
+		{fmt.Errorf("POST /nodes/pve1/qemu/104/status/start returned 503 Service Unavailable"), true},
+		{fmt.Errorf("qm start 104: %w after 2m0s", errCommandTimeout), false},
+		{fmt.Errorf("exit status 2: Configuration file 'nodes/pve1/qemu-server/104.conf' does not exist"), false},
+		{fmt.Errorf("POST /nodes/pve1/qemu/104/status/start returned 403 Permission check failed"), false},
+	}
+
+	for _, test := range tests {
+		if isTransientError(test.err) != test.transient {
+			t.Errorf("error '%v': expected transient=%v", test.err, test.transient)
+		}
+	}
+}
+
+func TestRetryTransient(t *testing.T) {
+	transientErr := fmt.Errorf("VM is locked (backup)")
+
+	tests := []struct {
+		name             string
+		policy           retryPolicy
+		failures         int
+		err              error
+		expectedAttempts int
+		expectedSleeps   []time.Duration
+		expectedError    string
+	}{
+		{"succeeds first time", retryPolicy{attempts: 3, backoff: 5 * time.Second}, 0, transientErr, 1, nil, ""},
+		{"succeeds after retries", retryPolicy{attempts: 3, backoff: 5 * time.Second}, 2, transientErr, 3, []time.Duration{5 * time.Second, 10 * time.Second}, ""},
+		{"gives up after attempts", retryPolicy{attempts: 3, backoff: 5 * time.Second}, 5, transientErr, 3, []time.Duration{5 * time.Second, 10 * time.Second}, "giving up after 3 attempt(s): VM is locked (backup)"},
+		{"backoff doubles every attempt", retryPolicy{attempts: 4, backoff: time.Second}, 3, transientErr, 4, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}, ""},
+		{"no retry for permanent error", retryPolicy{attempts: 3, backoff: 5 * time.Second}, 1, fmt.Errorf("no such VM"), 1, nil, "no such VM"},
+		{"no retry for timeout", retryPolicy{attempts: 3, backoff: 5 * time.Second}, 1, fmt.Errorf("qm start 104: %w", errCommandTimeout), 1, nil, "qm start 104: command timed out"},
+		{"single attempt policy", retryPolicy{attempts: 1, backoff: 5 * time.Second}, 1, transientErr, 1, nil, "VM is locked (backup)"},
+	}
+
+	for _, test := range tests {
+		sleeps := setTestRetryPolicy(t, test.policy)
+
+		attempts := 0
+		failures := test.failures
+		err := retryTransient("to start VM 104 - test", func() (err error) {
+			attempts++
+			if failures > 0 {
+				failures--
+				err = test.err
+			}
+			return
+		})
+
+		if test.expectedError == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if test.expectedError != "" && (err == nil || err.Error() != test.expectedError) {
+			t.Errorf("%s: expected error '%s', got: %v", test.name, test.expectedError, err)
+		}
+		if test.policy.attempts == 1 && err != nil && strings.Contains(err.Error(), "giving up") {
+			t.Errorf("%s: expected no retry summary with a single attempt, got: %v", test.name, err)
+		}
+		if attempts != test.expectedAttempts {
+			t.Errorf("%s: expected %d attempt(s), got %d", test.name, test.expectedAttempts, attempts)
+		}
+		if !reflect.DeepEqual(*sleeps, test.expectedSleeps) {
+			t.Errorf("%s: expected backoff %v, got %v", test.name, test.expectedSleeps, *sleeps)
+		}
+	}
+}
+
+func TestPowerOnRetriesTransientStart(t *testing.T) {
+	sleeps := setTestRetryPolicy(t, retryPolicy{attempts: 3, backoff: 5 * time.Second})
+	guest := GuestConfig{VMID: "104", Type: "qemu-server", Name: "web01"}
+
+	controller := &stubController{state: guestStopped, actionErr: fmt.Errorf("can't lock file '/var/lock/qemu-server/lock-104.conf' - got timeout"), failures: 2}
+	err := powerOn(controller, guest, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(controller.calls, []string{"status", "start", "start", "start"}) {
+		t.Errorf("expected status then three start attempts, got %v", controller.calls)
+	}
+	if !reflect.DeepEqual(*sleeps, []time.Duration{5 * time.Second, 10 * time.Second}) {
+		t.Errorf("expected backoff [5s 10s], got %v", *sleeps)
+	}
+
+	// Status failures are retried with the same policy
+	*sleeps = nil
+	controller = &stubController{state: guestStopped, statusErr: fmt.Errorf("VM is locked (backup)")}
+	err = powerOn(controller, guest, false)
+	if err == nil || !strings.Contains(err.Error(), "failed to check status of VM 104 - web01: giving up after 3 attempt(s)") {
+		t.Errorf("expected status error after 3 attempts, got: %v", err)
+	}
+	if !reflect.DeepEqual(controller.calls, []string{"status", "status", "status"}) {
+		t.Errorf("expected three status attempts and no start, got %v", controller.calls)
+	}
+	if !reflect.DeepEqual(*sleeps, []time.Duration{5 * time.Second, 10 * time.Second}) {
+		t.Errorf("expected backoff [5s 10s], got %v", *sleeps)
+	}
+}
+
+func TestParseVerboseStatus(t *testing.T) {
+	tests := []struct {
+		name          string
+		output        string
+		expectedState GuestState
+	}{
+		{"VM running", "cpus: 4\nname: web01\nqmpstatus: running\nrunning-machine: pc-i440fx-8.1+pve0\nstatus: running\nuptime: 5123\nvmid: 104\n", guestRunning},
+		{"VM paused", "cpus: 4\nname: web01\nqmpstatus: paused\nstatus: running\nuptime: 5123\nvmid: 104\n", guestPaused},
+		{"VM prelaunch", "name: web01\nqmpstatus: prelaunch\nstatus: running\nvmid: 104\n", guestPaused},
+		{"VM suspended to RAM", "name: web01\nqmpstatus: suspended\nstatus: running\nvmid: 104\n", guestSuspended},
+		{"VM hibernated", "lock: suspended\nname: web01\nqmpstatus: stopped\nstatus: stopped\nvmid: 104\n", guestHibernated},
+		{"VM stopped", "name: web01\nqmpstatus: stopped\nstatus: stopped\nvmid: 104\n", guestStopped},
+		{"VM locked by backup", "lock: backup\nname: web01\nstatus: stopped\nvmid: 104\n", guestStopped},
+		{"LXC running", "cpus: 2\nname: fileserver\nstatus: running\ntype: lxc\nvmid: 200\n", guestRunning},
+		{"LXC stopped", "cpus: 2\nname: fileserver\nstatus: stopped\ntype: lxc\nvmid: 200\n", guestStopped},
+		{"extra spacing", "  status :  running  \n  qmpstatus :  paused\n", guestPaused},
+		{"empty output", "", guestStopped},
+	}
+
+	for _, test := range tests {
+		state := parseVerboseStatus(test.output)
+		if state != test.expectedState {
+			t.Errorf("%s: expected state %s, got %s", test.name, test.expectedState, state)
+		}
+	}
+}
+
+func TestPowerOnActionForState(t *testing.T) {
+	setTestRetryPolicy(t, retryPolicy{attempts: 1})
+	guest := GuestConfig{VMID: "104", Type: "qemu-server", Name: "web01"}
+
+	tests := []struct {
+		output         string // qm status --verbose
+		expectedAction string
+	}{
+		{"qmpstatus: running\nstatus: running\n", ""},
+		{"qmpstatus: paused\nstatus: running\n", "resume"},
+		{"qmpstatus: prelaunch\nstatus: running\n", "resume"},
+		{"qmpstatus: suspended\nstatus: running\n", "wakeup"},
+		{"lock: suspended\nstatus: stopped\n", "start"},
+		{"status: stopped\n", "start"},
+	}
+
+	for _, test := range tests {
+		controller := &stubController{state: parseVerboseStatus(test.output)}
+		err := powerOn(controller, guest, false)
+
+		if test.expectedAction == "" {
+			if err == nil || !strings.Contains(err.Error(), "already running") {
+				t.Errorf("status %q: expected already running error, got: %v", test.output, err)
+			}
+			if len(controller.calls) != 1 {
+				t.Errorf("status %q: expected no action, got %v", test.output, controller.calls)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("status %q: unexpected error: %v", test.output, err)
+			continue
+		}
+		if !reflect.DeepEqual(controller.calls, []string{"status", test.expectedAction}) {
+			t.Errorf("status %q: expected %s, got %v", test.output, test.expectedAction, controller.calls)
+		}
+	}
+
+	// Frozen containers (reported by lxc-info, not pct status) are resumed
+	controller := &stubController{state: guestFrozen}
+	err := powerOn(controller, GuestConfig{VMID: "200", Type: "lxc", Name: "fileserver"}, false)
+	if err != nil || !reflect.DeepEqual(controller.calls, []string{"status", "resume"}) {
+		t.Errorf("frozen LXC: expected resume, got %v (%v)", controller.calls, err)
+	}
+
+	// Dry run only checks the status
+	controller = &stubController{state: guestPaused}
+	err = powerOn(controller, guest, true)
+	if err != nil || !reflect.DeepEqual(controller.calls, []string{"status"}) {
+		t.Errorf("dry run: expected only a status check, got %v (%v)", controller.calls, err)
+	}
+}
@@ -0,0 +1,105 @@
+// wakeonlanpve
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Guest power on request handed from a capture listener to the worker pool
+type wakeRequest struct {
+	guest  GuestConfig
+	dryRun bool
+}
+
+// Runs power on requests outside of the capture loops so slow starts never stall packet capture
+// At most one start per guest runs at a time, and the number of workers bounds concurrent starts
+type wakeWorkerPool struct {
+	queue         chan wakeRequest
+	blockWhenFull bool // Wait for a free queue slot instead of dropping requests (capture replay)
+	workers       sync.WaitGroup
+	locksMutex    sync.Mutex
+	guestLocks    map[string]*sync.Mutex // Keyed by guest type/VMID
+}
+
+// Worker pool sizing if not set in config
+const defaultMaxConcurrentStarts int = 4
+const defaultWakeQueueSize int = 64
+
+// Creates worker pool and starts its workers
+func startWakeWorkers(maxConcurrentStarts int, queueSize int) (pool *wakeWorkerPool) {
+	pool = &wakeWorkerPool{
+		queue:      make(chan wakeRequest, queueSize),
+		guestLocks: make(map[string]*sync.Mutex),
+	}
+
+	for range maxConcurrentStarts {
+		pool.workers.Add(1)
+		go pool.worker()
+	}
+	return
+}
+
+// Adds request to the queue without blocking the caller - requests are dropped when the queue is full
+// Unless blockWhenFull is set, then the caller waits until a worker takes a queued request
+func (pool *wakeWorkerPool) enqueue(request wakeRequest) (err error) {
+	if pool.blockWhenFull {
+		pool.queue <- request
+		return
+	}
+
+	select {
+	case pool.queue <- request:
+	default:
+		err = fmt.Errorf("wake queue is full (%d pending)", cap(pool.queue))
+	}
+	return
+}
+
+// Stops accepting requests and waits for all queued requests to finish
+func (pool *wakeWorkerPool) drain() {
+	close(pool.queue)
+	pool.workers.Wait()
+}
+
+// Processes queued requests until the queue is closed
+func (pool *wakeWorkerPool) worker() {
+	defer pool.workers.Done()
+
+	for request := range pool.queue {
+		pool.process(request)
+	}
+}
+
+// Powers on the guest while holding its lock - skipped if a start for the same guest is already in progress
+func (pool *wakeWorkerPool) process(request wakeRequest) {
+	guest := request.guest
+
+	guestLock := pool.guestLock(guest)
+	if !guestLock.TryLock() {
+		logMessage("Start already in progress for %s %s - %s, skipping", guestTypeName(guest.Type), guest.VMID, guest.Name)
+		return
+	}
+	defer guestLock.Unlock()
+
+	// Power on VM through the configured backend
+	err := powerOn(guestController, guest, request.dryRun)
+	if err != nil {
+		logMessage("%v", err)
+		return
+	}
+}
+
+// Retrieves (creating if needed) the lock for a guest
+func (pool *wakeWorkerPool) guestLock(guest GuestConfig) (guestLock *sync.Mutex) {
+	pool.locksMutex.Lock()
+	defer pool.locksMutex.Unlock()
+
+	guestKey := guest.Type + "/" + guest.VMID
+	guestLock, exists := pool.guestLocks[guestKey]
+	if !exists {
+		guestLock = &sync.Mutex{}
+		pool.guestLocks[guestKey] = guestLock
+	}
+	return
+}
@@ -0,0 +1,62 @@
+// wakeonlanpve
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWakeQueueFull(t *testing.T) {
+	// No workers, so nothing is taken off the queue
+	pool := &wakeWorkerPool{queue: make(chan wakeRequest, 1)}
+	request := wakeRequest{guest: GuestConfig{VMID: "104", Type: "qemu-server"}}
+
+	err := pool.enqueue(request)
+	if err != nil {
+		t.Fatalf("unexpected error queueing first request: %v", err)
+	}
+
+	err = pool.enqueue(request)
+	if err == nil || !strings.Contains(err.Error(), "wake queue is full") {
+		t.Errorf("expected full queue to drop the request, got: %v", err)
+	}
+}
+
+func TestWakeQueueBlockWhenFull(t *testing.T) {
+	pool := &wakeWorkerPool{queue: make(chan wakeRequest, 1), blockWhenFull: true}
+	request := wakeRequest{guest: GuestConfig{VMID: "104", Type: "qemu-server"}}
+
+	err := pool.enqueue(request)
+	if err != nil {
+		t.Fatalf("unexpected error queueing first request: %v", err)
+	}
+
+	enqueued := make(chan error, 1)
+	go func() {
+		enqueued <- pool.enqueue(wakeRequest{guest: GuestConfig{VMID: "105", Type: "qemu-server"}})
+	}()
+
+	select {
+	case err = <-enqueued:
+		t.Fatalf("expected enqueue to wait for a free slot, returned: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Worker taking the first request frees the slot
+	<-pool.queue
+
+	select {
+	case err = <-enqueued:
+		if err != nil {
+			t.Errorf("unexpected error queueing second request: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("enqueue did not return after a slot was freed")
+	}
+
+	queued := <-pool.queue
+	if queued.guest.VMID != "105" {
+		t.Errorf("expected second request to be queued, got guest %s", queued.guest.VMID)
+	}
+}